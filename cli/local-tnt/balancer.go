@@ -0,0 +1,270 @@
+package main
+
+import (
+	"errors"
+	"hash/fnv"
+	"log"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	tnt "github.com/rockdragon/TNT/tnt"
+)
+
+// strategies of balancer
+const (
+	balanceRoundRobin    = "round-robin"
+	balanceLeastConn     = "least-conn"
+	balanceLowestLatency = "lowest-latency"
+	balanceSticky        = "sticky"
+
+	defaultHealthInterval = 30 * time.Second
+)
+
+var errNoUpstream = errors.New("no upstream server available")
+
+// upstream a server of local
+type upstream struct {
+	addr    string
+	cipher  *tnt.Cipher
+	muxPool *tnt.MuxPool
+	active  int64 // connections in flight
+
+	mu      sync.Mutex
+	alive   bool
+	latency time.Duration
+}
+
+func (u *upstream) isAlive() bool {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return u.alive
+}
+
+func (u *upstream) getLatency() time.Duration {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return u.latency
+}
+
+func (u *upstream) setAlive(alive bool, latency time.Duration) {
+	u.mu.Lock()
+	changed := u.alive != alive
+	u.alive = alive
+	if alive {
+		u.latency = latency
+	}
+	u.mu.Unlock()
+	if changed {
+		if alive {
+			log.Println("[BALANCE] server up", u.addr, latency)
+		} else {
+			log.Println("[BALANCE] server down", u.addr)
+		}
+	}
+}
+
+// upstreamConn connection counted as in flight until closed
+type upstreamConn struct {
+	net.Conn
+	up   *upstream
+	once sync.Once
+}
+
+func (c *upstreamConn) Close() error {
+	c.once.Do(func() {
+		atomic.AddInt64(&c.up.active, -1)
+	})
+	return c.Conn.Close()
+}
+
+// balancer choose an upstream for every new connection, connections in
+// flight stay on the upstream they started with.
+type balancer struct {
+	strategy  string
+	upstreams []*upstream
+	next      uint32
+}
+
+// newServers balancer of servers in config, the single server if none
+func newServers() (*balancer, error) {
+	list := config.Servers
+	if len(list) == 0 {
+		list = []*tnt.Server{{Server: config.ServerAddr, Method: config.Method, Password: config.Password}}
+	}
+	var upstreams []*upstream
+	for _, s := range list {
+		cipher, err := tnt.NewCipherWithKDF(s.Method, s.Password, config.KDFOf(s.Method))
+		if err != nil {
+			return nil, err
+		}
+		u := &upstream{addr: s.Server, cipher: cipher}
+		if config.Mux > 0 {
+			u.muxPool = tnt.NewMuxPool(config.Mux, network, s.Server, cipher)
+		}
+		upstreams = append(upstreams, u)
+	}
+	b, err := newBalancer(config.Balance, upstreams)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(upstreams) > 1 {
+		probe := rawAddr
+		if config.HealthCheck != "" {
+			if probe, err = tnt.AddrRawAddr(config.HealthCheck); err != nil {
+				return nil, err
+			}
+		}
+		interval := defaultHealthInterval
+		if config.HealthInterval > 0 {
+			interval = time.Duration(config.HealthInterval) * time.Second
+		}
+		go b.healthCheck(probe, interval)
+	}
+	return b, nil
+}
+
+func newBalancer(strategy string, upstreams []*upstream) (*balancer, error) {
+	switch strategy {
+	case "":
+		strategy = balanceRoundRobin
+	case balanceRoundRobin, balanceLeastConn, balanceLowestLatency, balanceSticky:
+	default:
+		return nil, errors.New("unknown balance strategy: " + strategy)
+	}
+	for _, u := range upstreams {
+		u.alive = true
+	}
+	return &balancer{strategy: strategy, upstreams: upstreams}, nil
+}
+
+// pick an upstream for destination host, skipping those tried.
+// servers down are chosen only if all are down.
+func (b *balancer) pick(host string, tried map[*upstream]bool) *upstream {
+	var candidates []*upstream
+	for _, u := range b.upstreams {
+		if !tried[u] && u.isAlive() {
+			candidates = append(candidates, u)
+		}
+	}
+	if len(candidates) == 0 {
+		for _, u := range b.upstreams {
+			if !tried[u] {
+				candidates = append(candidates, u)
+			}
+		}
+	}
+	if len(candidates) == 0 {
+		return nil
+	}
+
+	switch b.strategy {
+	case balanceLeastConn:
+		best := candidates[0]
+		for _, u := range candidates[1:] {
+			if atomic.LoadInt64(&u.active) < atomic.LoadInt64(&best.active) {
+				best = u
+			}
+		}
+		return best
+	case balanceLowestLatency:
+		best := candidates[0]
+		for _, u := range candidates[1:] {
+			if u.getLatency() < best.getLatency() {
+				best = u
+			}
+		}
+		return best
+	case balanceSticky:
+		// rendezvous hashing, only destinations of a failed server move
+		var best *upstream
+		var bestScore uint64
+		for _, u := range candidates {
+			h := fnv.New64a()
+			h.Write([]byte(host))
+			h.Write([]byte(u.addr))
+			if score := h.Sum64(); best == nil || score > bestScore {
+				best, bestScore = u, score
+			}
+		}
+		return best
+	default:
+		n := atomic.AddUint32(&b.next, 1)
+		return candidates[n%uint32(len(candidates))]
+	}
+}
+
+// dial through an upstream chosen for host, fail over to the others
+// until one is reachable.
+func (b *balancer) dial(host string, dial func(u *upstream) (net.Conn, error)) (net.Conn, *upstream, error) {
+	tried := make(map[*upstream]bool)
+	err := errNoUpstream
+	for {
+		u := b.pick(host, tried)
+		if u == nil {
+			return nil, nil, err
+		}
+		tried[u] = true
+		var c net.Conn
+		if c, err = dial(u); err == nil {
+			atomic.AddInt64(&u.active, 1)
+			return &upstreamConn{Conn: c, up: u}, u, nil
+		}
+		log.Println("[BALANCE] dial error", u.addr, err)
+		u.setAlive(false, 0)
+	}
+}
+
+// healthCheck probe rawaddr through every upstream each interval
+func (b *balancer) healthCheck(rawaddr []byte, interval time.Duration) {
+	for {
+		for _, u := range b.upstreams {
+			go u.probe(rawaddr)
+		}
+		time.Sleep(interval)
+	}
+}
+
+// probe connect to rawaddr through the tunnel, as the user traffic goes.
+// Only a broken tunnel or a server failure marks upstream down, the
+// target refused or unreachable is no fault of the server.
+func (u *upstream) probe(rawaddr []byte) {
+	start := time.Now()
+	remote, rep, _, err := u.connect(rawaddr, 0)
+	if err != nil {
+		u.setAlive(false, 0)
+		return
+	}
+	remote.Close()
+	if rep == tnt.RepServerFailure {
+		u.setAlive(false, 0)
+		return
+	}
+	u.setAlive(true, time.Since(start))
+}
+
+// connect open a stream if mux enabled, otherwise a connection
+func (u *upstream) connect(rawaddr []byte, flags uint8) (net.Conn, uint8, []byte, error) {
+	if u.muxPool != nil {
+		st, rep, bound, err := u.muxPool.Open(rawaddr, flags)
+		if err != nil {
+			return nil, 0, nil, err
+		}
+		return st, rep, bound, nil
+	}
+	if tnt.TrafficVersion == tnt.TrafficVersion1 {
+		// server of version 1 never reply
+		c, err := tnt.ConnectToServer(network, u.addr, tnt.TrafficRequest, rawaddr, u.cipher.Copy())
+		if err != nil {
+			return nil, 0, nil, err
+		}
+		return c, tnt.RepSucceeded, tnt.IPRawAddr(net.IPv4zero, 0), nil
+	}
+	c, rep, bound, err := tnt.ConnectWithReply(network, u.addr, rawaddr, flags, u.cipher.Copy())
+	if err != nil {
+		return nil, 0, nil, err
+	}
+	return c, rep, bound, nil
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"net"
+	"testing"
+
+	"github.com/rockdragon/TNT/tnt"
+)
+
+// replyServer server answering every request with rep
+func replyServer(t *testing.T, cipher *tnt.Cipher, rep uint8) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			c := tnt.NewConn(conn, cipher.Copy())
+			if _, err = tnt.UnMarshalTraffic(c); err == nil {
+				tnt.WriteReply(c, rep, tnt.IPRawAddr(net.IPv4zero, 0))
+			}
+			c.Close()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+func TestProbe(t *testing.T) {
+	cipher, err := tnt.NewCipher("aes-256-cfb", "pw")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rawaddr := tnt.IPRawAddr(net.IPv4(127, 0, 0, 1), 80)
+
+	for _, c := range []struct {
+		rep   uint8
+		alive bool
+	}{
+		{tnt.RepSucceeded, true},
+		{tnt.RepConnectionRefused, true},
+		{tnt.RepHostUnreachable, true},
+		{tnt.RepNotAllowed, true},
+		{tnt.RepServerFailure, false},
+	} {
+		u := &upstream{addr: replyServer(t, cipher, c.rep), cipher: cipher, alive: !c.alive}
+		u.probe(rawaddr)
+		if u.isAlive() != c.alive {
+			t.Errorf("rep %d: alive %v", c.rep, u.isAlive())
+		}
+	}
+
+	// tunnel unreachable
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln.Close()
+	u := &upstream{addr: ln.Addr().String(), cipher: cipher, alive: true}
+	u.probe(rawaddr)
+	if u.isAlive() {
+		t.Error("unreachable server alive")
+	}
+}
+
+func TestRoundRobinWrap(t *testing.T) {
+	upstreams := []*upstream{{addr: "a"}, {addr: "b"}, {addr: "c"}}
+	b, err := newBalancer(balanceRoundRobin, upstreams)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// int of uint32 above 1<<31 is negative on 32-bit platforms
+	b.next = 1<<32 - 4
+	seen := make(map[string]int)
+	for i := 0; i < 6; i++ {
+		seen[b.pick("", nil).addr]++
+	}
+	for _, u := range upstreams {
+		if seen[u.addr] != 2 {
+			t.Fatalf("picked %v", seen)
+		}
+	}
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"log"
+	"net"
+
+	tnt "github.com/rockdragon/TNT/tnt"
+)
+
+// listenForward pipe every connection accepted on f.Local to f.Target,
+// with no socks negotiation.
+func listenForward(f *tnt.Forward) error {
+	rawaddr, err := tnt.AddrRawAddr(f.Target)
+	if err != nil {
+		return err
+	}
+	ln, err := net.Listen(network, f.Local)
+	if err != nil {
+		return err
+	}
+	log.Println("Forward is Listening:", network, f.Local, "->", f.Target)
+
+	go serve(ln, func(conn net.Conn) {
+		defer conn.Close()
+
+		remote, rep, _, err := connectWithFlags(rawaddr, tnt.FlagForward)
+		if err != nil {
+			log.Println("Connect to target server failed", err)
+			return
+		}
+		if rep != tnt.RepSucceeded {
+			log.Println("[REP]", rep, f.Target)
+			return
+		}
+		relay(conn, remote)
+	})
+	return nil
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"bufio"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+
+	tnt "github.com/rockdragon/TNT/tnt"
+)
+
+// hop-by-hop headers, never forwarded
+var hopHeaders = []string{
+	"Connection",
+	"Proxy-Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// isHTTPMethod whether b can be the first byte of an http method
+func isHTTPMethod(b byte) bool {
+	return b >= 'A' && b <= 'Z'
+}
+
+func removeHopHeaders(h http.Header) {
+	for _, f := range h["Connection"] {
+		for _, name := range strings.Split(f, ",") {
+			h.Del(strings.TrimSpace(name))
+		}
+	}
+	for _, name := range hopHeaders {
+		h.Del(name)
+	}
+}
+
+// hostPort of request, with default port of scheme
+func hostPort(req *http.Request) string {
+	host := req.URL.Host
+	if host == "" {
+		host = req.Host
+	}
+	if _, _, err := net.SplitHostPort(host); err != nil {
+		host = strings.TrimSuffix(strings.TrimPrefix(host, "["), "]")
+		if req.Method == http.MethodConnect || req.URL.Scheme == "https" {
+			return net.JoinHostPort(host, "443")
+		}
+		return net.JoinHostPort(host, "80")
+	}
+	return host
+}
+
+func httpError(conn net.Conn, code int) {
+	resp := &http.Response{
+		StatusCode: code,
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     make(http.Header),
+		Close:      true,
+	}
+	if code == http.StatusProxyAuthRequired {
+		resp.Header.Set("Proxy-Authenticate", `Basic realm="TNT"`)
+	}
+	resp.Write(conn)
+}
+
+// repStatus http status according to socks5 reply code
+func repStatus(rep uint8) int {
+	switch rep {
+	case tnt.RepNotAllowed:
+		return http.StatusForbidden
+	case tnt.RepTTLExpired:
+		return http.StatusGatewayTimeout
+	default:
+		return http.StatusBadGateway
+	}
+}
+
+// proxyAuthorized check Proxy-Authorization against credentials
+func proxyAuthorized(req *http.Request) bool {
+	if credentials == nil {
+		return true
+	}
+	auth := req.Header.Get("Proxy-Authorization")
+	if !strings.HasPrefix(auth, "Basic ") {
+		return false
+	}
+	decoded, err := base64.StdEncoding.DecodeString(auth[len("Basic "):])
+	if err != nil {
+		return false
+	}
+	i := strings.IndexByte(string(decoded), ':')
+	if i < 0 {
+		return false
+	}
+	return credentials.Verify(string(decoded[:i]), string(decoded[i+1:]))
+}
+
+// dialHTTP connect to host:port through tunnel
+func dialHTTP(host string) (remote net.Conn, status int) {
+	rawaddr, err := tnt.AddrRawAddr(host)
+	if err != nil {
+		return nil, http.StatusBadRequest
+	}
+	remote, rep, _, err := connectToServer(rawaddr)
+	if err != nil {
+		log.Println("Connect to target server failed", err)
+		return nil, http.StatusBadGateway
+	}
+	if rep != tnt.RepSucceeded {
+		log.Println("[REP]", rep, host)
+		return nil, repStatus(rep)
+	}
+	return remote, http.StatusOK
+}
+
+// rountine of http proxy connection, CONNECT tunnels and
+// absolute-URI forward requests.
+func handleHTTP(conn *peekConn) {
+	var remote net.Conn
+	var remoteHost string
+	var remoteReader *bufio.Reader
+	defer func() {
+		if remote != nil {
+			remote.Close()
+		}
+	}()
+
+	for {
+		tnt.SetReadTimeout(conn.Conn)
+		req, err := http.ReadRequest(conn.r)
+		if err != nil {
+			if err != io.EOF {
+				log.Println("[HTTP Request Error]", err)
+			}
+			return
+		}
+		if !proxyAuthorized(req) {
+			httpError(conn, http.StatusProxyAuthRequired)
+			return
+		}
+
+		host := hostPort(req)
+		log.Println("[HTTP Request]", req.Method, host)
+
+		if req.Method == http.MethodConnect {
+			tunnel, status := dialHTTP(host)
+			if tunnel == nil {
+				httpError(conn, status)
+				return
+			}
+			fmt.Fprintf(conn, "HTTP/1.1 200 Connection established\r\n\r\n")
+			relay(conn, tunnel)
+			return
+		}
+
+		if !req.URL.IsAbs() {
+			httpError(conn, http.StatusBadRequest)
+			return
+		}
+		if remote == nil || remoteHost != host {
+			if remote != nil {
+				remote.Close()
+			}
+			var status int
+			if remote, status = dialHTTP(host); remote == nil {
+				httpError(conn, status)
+				return
+			}
+			remoteHost = host
+			remoteReader = bufio.NewReader(remote)
+		}
+
+		keepAlive := !req.Close
+		removeHopHeaders(req.Header)
+		req.RequestURI = ""
+		if err = req.Write(remote); err != nil {
+			log.Println("[HTTP Forward Error]", err)
+			return
+		}
+
+		tnt.SetReadTimeout(remote)
+		resp, err := http.ReadResponse(remoteReader, req)
+		if err != nil {
+			log.Println("[HTTP Response Error]", err)
+			httpError(conn, http.StatusBadGateway)
+			return
+		}
+		keepAlive = keepAlive && !resp.Close
+		removeHopHeaders(resp.Header)
+		resp.Close = !keepAlive
+		err = resp.Write(conn)
+		resp.Body.Close()
+		if err != nil || !keepAlive {
+			return
+		}
+	}
+}
+
+// handleHTTPConn rountine of dedicated http proxy listener
+func handleHTTPConn(conn net.Conn) {
+	defer conn.Close()
+	handleHTTP(newPeekConn(conn))
+}
@@ -1,16 +1,20 @@
 package main
 
 import (
+	"bufio"
 	"encoding/binary"
 	"errors"
 	"flag"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"log"
 	"math/rand"
 	"net"
 	"os"
 	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	tnt "github.com/rockdragon/TNT/tnt"
@@ -30,7 +34,18 @@ const (
 	layoutRSV        = 2
 	layoutATYP       = 3
 	layoutAddr       = 4
+
+	methodNoAuth       = 0x00
+	methodUserPass     = 0x02
+	methodNoAcceptable = 0xFF
+	userPassVersion    = 0x01
+
 	typeConnect      = 1
+	typeBind         = 2
+	typeUDPAssociate = 3
+
+	// interval of checking rules file for modification
+	rulesReload = 5 * time.Second
 
 	typeIPv4   = uint8(1)                // type is ipv4 address
 	typeDomain = uint8(3)                // type is domain address
@@ -47,6 +62,9 @@ var (
 	config       *tnt.Config
 	errNS        error
 	cipher       *tnt.Cipher
+	servers      *balancer
+	rules        *tnt.Rules
+	credentials  *tnt.Credentials
 	shutdown     chan struct{}
 )
 
@@ -115,8 +133,8 @@ func extractRequest(conn net.Conn) (socksReq *tnt.Socks5Request, err error) {
 		return
 	}
 	command := uint8(buf[layoutCommand])
-	if command != typeConnect {
-		err = errors.New("only CONNECT be able to accept")
+	if command != typeConnect && command != typeBind && command != typeUDPAssociate {
+		err = fmt.Errorf("unknown command: %d", command)
 		return
 	}
 	RSV := uint8(buf[layoutRSV])
@@ -127,17 +145,17 @@ func extractRequest(conn net.Conn) (socksReq *tnt.Socks5Request, err error) {
 
 	switch ATYP {
 	case typeIPv4:
-		if _, err = io.ReadFull(conn, buf[layoutAddr:layoutAddr+lenIPv4]); err != nil {
+		if _, err = io.ReadFull(conn, buf[layoutAddr:layoutAddr+net.IPv4len]); err != nil {
 			return
 		}
-		addrEnd = layoutAddr + lenIPv4
+		addrEnd = layoutAddr + net.IPv4len
 		address = net.IP(buf[layoutAddr:addrEnd]).String()
 		reqLen = lenIPv4
 	case typeIPv6:
-		if _, err = io.ReadFull(conn, buf[layoutAddr:layoutAddr+lenIPv6]); err != nil {
+		if _, err = io.ReadFull(conn, buf[layoutAddr:layoutAddr+net.IPv6len]); err != nil {
 			return
 		}
-		addrEnd = layoutAddr + lenIPv6
+		addrEnd = layoutAddr + net.IPv6len
 		address = net.IP(buf[layoutAddr:addrEnd]).String()
 		reqLen = lenIPv6
 	case typeDomain:
@@ -176,22 +194,77 @@ func extractRequest(conn net.Conn) (socksReq *tnt.Socks5Request, err error) {
 // |VER | METHOD |
 // +----+--------+
 // | 1  |   1    |
-func replyNegotiation(conn net.Conn, socks *tnt.Socks5Negotiation) {
-	// no authentication required
-	reply(conn, []byte{socksVersion, 0x00})
+func replyNegotiation(conn net.Conn, socks *tnt.Socks5Negotiation) (method uint8) {
+	wanted := uint8(methodNoAuth)
+	if credentials != nil {
+		wanted = methodUserPass
+	}
+	method = methodNoAcceptable
+	for _, m := range socks.Methods {
+		if m == wanted {
+			method = wanted
+		}
+	}
+	reply(conn, []byte{socksVersion, method})
+	return
+}
+
+// authenticate username/password sub-negotiation, RFC 1929
+// |VER | ULEN |  UNAME   | PLEN |  PASSWD  |
+// +----+------+----------+------+----------+
+// | 1  |  1   | 1 to 255 |  1   | 1 to 255 |
+// replied with
+// |VER | STATUS |
+// +----+--------+
+// | 1  |   1    |
+func authenticate(conn net.Conn) (err error) {
+	buf := make([]byte, 255)
+	if _, err = io.ReadFull(conn, buf[:2]); err != nil {
+		return
+	}
+	if buf[0] != userPassVersion {
+		return fmt.Errorf("unknown auth version: %d", buf[0])
+	}
+	ulen := buf[1]
+	if _, err = io.ReadFull(conn, buf[:ulen]); err != nil {
+		return
+	}
+	username := string(buf[:ulen])
+	if _, err = io.ReadFull(conn, buf[:1]); err != nil {
+		return
+	}
+	plen := buf[0]
+	if _, err = io.ReadFull(conn, buf[:plen]); err != nil {
+		return
+	}
+	password := string(buf[:plen])
+
+	if !credentials.Verify(username, password) {
+		reply(conn, []byte{userPassVersion, 0x01})
+		return fmt.Errorf("invalid credentials of %s", username)
+	}
+	log.Println("[AUTH]", username)
+	reply(conn, []byte{userPassVersion, 0x00})
+	return
 }
 
 // reply the request
 // |VER | REP |  RSV  | ATYP | BND.ADDR | BND.PORT |
 // +----+-----+-------+------+----------+----------+
 // | 1  |  1  | X'00' |  1   | Variable |    2     |
-func replyRequest(conn net.Conn, socksRequest *tnt.Socks5Request) {
-	reply(conn, []byte{0x05, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00, 0x80, 0x88})
+// replyWithAddr reply the request with rep and bound address
+func replyWithAddr(conn net.Conn, rep uint8, ip net.IP, port int) {
+	replyWithRawAddr(conn, rep, tnt.IPRawAddr(ip, port))
+}
+
+func replyWithRawAddr(conn net.Conn, rep uint8, rawaddr []byte) {
+	reply(conn, append([]byte{socksVersion, rep, 0x00}, rawaddr...))
 }
 
-func sendMeaninglessPayload(cipher *tnt.Cipher) {
-	remote, err := tnt.ConnectToServer(network, config.ServerAddr,
-		tnt.TrafficMeaningless, rawAddr, cipher)
+func sendMeaninglessPayload() {
+	remote, _, err := servers.dial("", func(u *upstream) (net.Conn, error) {
+		return tnt.ConnectToServer(network, u.addr, tnt.TrafficMeaningless, rawAddr, u.cipher.Copy())
+	})
 	if err != nil {
 		log.Println("Connect to target server failed", err)
 		return
@@ -206,7 +279,7 @@ func sendMeaninglessPayload(cipher *tnt.Cipher) {
 	tnt.Drain(remote)
 }
 
-func eventLoop(cipher *tnt.Cipher) {
+func eventLoop() {
 	ticker := time.NewTicker(1 * time.Second)
 	defer func() {
 		ticker.Stop()
@@ -217,7 +290,7 @@ func eventLoop(cipher *tnt.Cipher) {
 		case <-ticker.C:
 			// log.Println("[TICKER]", requestQueue.Size())
 			if requestQueue.Size() == 0 {
-				sendMeaninglessPayload(cipher.Copy())
+				sendMeaninglessPayload()
 			}
 		case <-shutdown:
 			break
@@ -225,11 +298,119 @@ func eventLoop(cipher *tnt.Cipher) {
 	}
 }
 
-// rountine of per connection
-// https://www.ietf.org/rfc/rfc1928.txt
-func handleConn(conn net.Conn, cipher *tnt.Cipher) {
+// connectToServer connect to rawaddr directly or through server as rules
+// decide, return with the dial result. remote is nil unless rep is
+// RepSucceeded.
+func connectToServer(rawaddr []byte) (remote net.Conn, rep uint8, bound []byte, err error) {
+	return connectWithFlags(rawaddr, 0)
+}
+
+func connectWithFlags(rawaddr []byte, flags uint8) (remote net.Conn, rep uint8, bound []byte, err error) {
+	if rules != nil && flags&tnt.FlagForward == 0 {
+		host, err := tnt.ParseRawAddr(rawaddr)
+		if err != nil {
+			return nil, 0, nil, err
+		}
+		switch action := rules.Match(host); action {
+		case tnt.ActionReject:
+			log.Println("[RULES]", action, host)
+			return nil, tnt.RepNotAllowed, tnt.IPRawAddr(net.IPv4zero, 0), nil
+		case tnt.ActionDirect:
+			log.Println("[RULES]", action, host)
+			return dialDirect(host)
+		}
+	}
+	if remote, rep, bound, err = dialTunnel(rawaddr, flags); err != nil {
+		return nil, 0, nil, err
+	}
+	if rep != tnt.RepSucceeded {
+		remote.Close()
+		remote = nil
+	}
+	return
+}
+
+// dialTunnel connect to rawaddr through an upstream server
+func dialTunnel(rawaddr []byte, flags uint8) (net.Conn, uint8, []byte, error) {
+	host, err := tnt.ParseRawAddr(rawaddr)
+	if err != nil {
+		return nil, 0, nil, err
+	}
+	var rep uint8
+	var bound []byte
+	remote, _, err := servers.dial(host, func(u *upstream) (c net.Conn, err error) {
+		c, rep, bound, err = u.connect(rawaddr, flags)
+		return
+	})
+	if err != nil {
+		return nil, 0, nil, err
+	}
+	return remote, rep, bound, nil
+}
+
+// dialDirect connect to host without tunnel
+func dialDirect(host string) (net.Conn, uint8, []byte, error) {
+	remote, err := net.Dial(network, host)
+	if err != nil {
+		log.Println("[DIRECT] dial error", err)
+		return nil, tnt.DialRep(err), tnt.IPRawAddr(net.IPv4zero, 0), nil
+	}
+	return remote, tnt.RepSucceeded, tnt.AddrOf(remote.LocalAddr()), nil
+}
+
+// peekConn conn able to peek before reading
+type peekConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func newPeekConn(conn net.Conn) *peekConn {
+	return &peekConn{Conn: conn, r: bufio.NewReader(conn)}
+}
+
+func (c *peekConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+// rountine of per connection, dispatch by the version byte
+func handleConn(conn net.Conn) {
 	defer conn.Close()
 
+	pc := newPeekConn(conn)
+	tnt.SetReadTimeout(conn)
+	first, err := pc.r.Peek(1)
+	if err != nil {
+		return
+	}
+	switch first[0] {
+	case socks4Version:
+		handleSocks4(pc)
+	case socksVersion:
+		handleSocks5(pc)
+	default:
+		if isHTTPMethod(first[0]) {
+			handleHTTP(pc)
+			return
+		}
+		log.Println("[Negotiate Request Error] unknown version", first[0])
+	}
+}
+
+// relay traffic between client and remote until either closed
+func relay(conn, remote net.Conn) {
+	requestQueue.Push(struct{}{})
+	defer func() {
+		requestQueue.Pop()
+		remote.Close()
+	}()
+
+	go tnt.Pipe(conn, remote)
+	tnt.Pipe(remote, conn)
+}
+
+// rountine of socks5 connection
+// https://www.ietf.org/rfc/rfc1928.txt
+func handleSocks5(conn net.Conn) {
 	// 1. extract info about negotiation
 	socks, err := extractNegotiation(conn)
 	if err != nil {
@@ -239,7 +420,16 @@ func handleConn(conn net.Conn, cipher *tnt.Cipher) {
 	log.Println(socks)
 
 	// 2. confirm negotiation
-	replyNegotiation(conn, socks)
+	switch replyNegotiation(conn, socks) {
+	case methodNoAcceptable:
+		log.Println("[Negotiate Request Error] no acceptable method")
+		return
+	case methodUserPass:
+		if err = authenticate(conn); err != nil {
+			log.Println("[Auth Error]", err)
+			return
+		}
+	}
 
 	// 3. extract info about request
 	socksRequest, err := extractRequest(conn)
@@ -249,30 +439,153 @@ func handleConn(conn net.Conn, cipher *tnt.Cipher) {
 	}
 	log.Println(socksRequest)
 
-	// 4. confirm the connection was established
-	replyRequest(conn, socksRequest)
+	switch socksRequest.Command {
+	case typeUDPAssociate:
+		handleUDPAssociate(conn)
+		return
+	case typeBind:
+		handleBind(conn, socksRequest)
+		return
+	}
 
-	// 5. connect to remote
-	remote, err := tnt.ConnectToServer(network, config.ServerAddr,
-		tnt.TrafficRequest, socksRequest.RawAddr, cipher)
+	// 4. connect to remote
+	remote, rep, bound, err := connectToServer(socksRequest.RawAddr)
 	if err != nil {
 		log.Println("Connect to target server failed", err)
+		replyWithAddr(conn, tnt.RepServerFailure, net.IPv4zero, 0)
 		return
 	}
-	requestQueue.Push(struct{}{})
-	defer func() {
-		requestQueue.Pop()
-		remote.Close()
-	}()
+
+	// 5. reply the dial result of server
+	replyWithRawAddr(conn, rep, bound)
+	if rep != tnt.RepSucceeded {
+		log.Println("[REP]", rep, socksRequest.AddressWithPort)
+		return
+	}
+	relay(conn, remote)
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "Usage of %s:\n", os.Args[0])
+	flag.PrintDefaults()
+	fmt.Fprintf(os.Stderr, "Supported methods:\n  %s\n", strings.Join(tnt.ListCiphers(), "\n  "))
+}
+
+// handleBind ask server to listen, reply twice as RFC 1928 requires:
+// the address server listens on, then the address of the inbound peer.
+func handleBind(conn net.Conn, socksRequest *tnt.Socks5Request) {
+	if tnt.TrafficVersion != tnt.TrafficVersion2 {
+		log.Println("[BIND] requires traffic version", tnt.TrafficVersion2)
+		replyWithAddr(conn, tnt.RepCommandNotSupported, net.IPv4zero, 0)
+		return
+	}
+	remote, _, err := servers.dial(socksRequest.Address, func(u *upstream) (net.Conn, error) {
+		return tnt.ConnectToServer(network, u.addr, tnt.TrafficBind, socksRequest.RawAddr, u.cipher.Copy())
+	})
+	if err != nil {
+		log.Println("Connect to target server failed", err)
+		replyWithAddr(conn, tnt.RepServerFailure, net.IPv4zero, 0)
+		return
+	}
+	defer remote.Close()
+
+	for i := 0; i < 2; i++ {
+		tnt.SetReadTimeout(remote)
+		rep, rawaddr, err := tnt.ReadReply(remote)
+		if err != nil {
+			log.Println("[BIND] reply error", err)
+			replyWithAddr(conn, tnt.RepServerFailure, net.IPv4zero, 0)
+			return
+		}
+		replyWithRawAddr(conn, rep, rawaddr)
+		if rep != tnt.RepSucceeded {
+			return
+		}
+	}
 
 	go tnt.Pipe(conn, remote)
 	tnt.Pipe(remote, conn)
+}
 
-	return
+// handleUDPAssociate relay datagrams of client through tunnel or directly as
+// rules decide, in an udp association which lives as long as the control connection.
+// +----+------+------+----------+----------+----------+
+// |RSV | FRAG | ATYP | DST.ADDR | DST.PORT |   DATA   |
+// +----+------+------+----------+----------+----------+
+// | 2  |  1   |  1   | Variable |    2     | Variable |
+// +----+------+------+----------+----------+----------+
+func handleUDPAssociate(conn net.Conn) {
+	if tnt.TrafficVersion != tnt.TrafficVersion2 {
+		log.Println("[UDP] requires traffic version", tnt.TrafficVersion2)
+		replyWithAddr(conn, tnt.RepCommandNotSupported, net.IPv4zero, 0)
+		return
+	}
+	localIP := conn.LocalAddr().(*net.TCPAddr).IP
+	pc, err := net.ListenUDP("udp", &net.UDPAddr{IP: localIP})
+	if err != nil {
+		log.Println("[UDP] listen error", err)
+		replyWithAddr(conn, tnt.RepServerFailure, net.IPv4zero, 0)
+		return
+	}
+	defer pc.Close()
+
+	clientIP := conn.RemoteAddr().(*net.TCPAddr).IP
+	var mu sync.Mutex
+	var client *net.UDPAddr
+
+	// replies -> client
+	route, err := newUDPRoute("", func(rawaddr, data []byte) {
+		mu.Lock()
+		addr := client
+		mu.Unlock()
+		if addr == nil {
+			return
+		}
+		packet := append(append([]byte{0, 0, 0}, rawaddr...), data...)
+		pc.WriteToUDP(packet, addr)
+	})
+	if err != nil {
+		log.Println("[UDP] listen error", err)
+		replyWithAddr(conn, tnt.RepServerFailure, net.IPv4zero, 0)
+		return
+	}
+	defer route.Close()
+
+	bound := pc.LocalAddr().(*net.UDPAddr)
+	replyWithAddr(conn, tnt.RepSucceeded, bound.IP, bound.Port)
+	log.Println("[UDP ASSOCIATE]", bound)
+
+	// client -> targets
+	go func() {
+		buf := make([]byte, 64*1024)
+		for {
+			n, addr, err := pc.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			if !addr.IP.Equal(clientIP) || n < 3 || buf[2] != 0 {
+				// not from client, or fragmented
+				continue
+			}
+			rawaddr, data, err := tnt.SplitRawAddr(buf[3:n])
+			if err != nil {
+				continue
+			}
+			mu.Lock()
+			client = addr
+			mu.Unlock()
+			route.send(rawaddr, data)
+		}
+	}()
+
+	// association ends with the control connection
+	conn.SetReadDeadline(time.Time{})
+	io.Copy(ioutil.Discard, conn)
 }
 
 func main() {
 	cfgfile := flag.String("c", "config.json", "config file path")
+	flag.Usage = usage
 	flag.Parse()
 
 	config, errNS = tnt.ParseConfig(*cfgfile)
@@ -282,6 +595,34 @@ func main() {
 	}
 	log.Println("[CONF]", config)
 
+	if len(config.SocksAuth) > 0 || config.SocksAuthFile != "" {
+		credentials, errNS = tnt.LoadCredentials(config.SocksAuth, config.SocksAuthFile)
+		if errNS != nil {
+			log.Println("Load Credentials Error", errNS)
+			os.Exit(1)
+		}
+	}
+
+	if config.GeoIP != "" {
+		if errNS = tnt.LoadGeoIP(config.GeoIP); errNS != nil {
+			log.Println("Load GeoIP Error", errNS)
+			os.Exit(1)
+		}
+	}
+	if config.GeoSite != "" {
+		if errNS = tnt.LoadGeoSite(config.GeoSite); errNS != nil {
+			log.Println("Load GeoSite Error", errNS)
+			os.Exit(1)
+		}
+	}
+	if config.Rules != "" {
+		if rules, errNS = tnt.LoadRules(config.Rules); errNS != nil {
+			log.Println("Load Rules Error", errNS)
+			os.Exit(1)
+		}
+		go rules.Watch(rulesReload)
+	}
+
 	rawAddr = tnt.RawAddr(config.TargetDomain, config.TargetPort)
 	httpHeader = tnt.HTTPProtocolHeader(config.TargetDomain)
 
@@ -292,17 +633,72 @@ func main() {
 		os.Exit(1)
 	}
 
-	cipher, err := tnt.NewCipher(config.Method, config.Password)
-	if err != nil {
-		log.Println("Generate Cipher Error", err)
+	if servers, err = newServers(); err != nil {
+		log.Println("Upstream Servers Error", err)
 		os.Exit(1)
 	}
 
-	go eventLoop(cipher)
+	go eventLoop()
 	defer func() {
 		shutdown <- struct{}{}
 	}()
 
+	if config.HTTPLocalAddr != "" {
+		log.Println("HTTP Proxy is Listening:", network, config.HTTPLocalAddr)
+		httpLn, err := net.Listen(network, config.HTTPLocalAddr)
+		if err != nil {
+			log.Println("Listen Error", err)
+			os.Exit(1)
+		}
+		go serve(httpLn, handleHTTPConn)
+	}
+
+	for _, f := range config.Forwards {
+		if err = listenForward(f); err != nil {
+			log.Println("Forward Error", err)
+			os.Exit(1)
+		}
+	}
+
+	for _, r := range config.Reverses {
+		rawaddr, err := tnt.AddrRawAddr(r.Remote)
+		if err != nil {
+			log.Println("Reverse Error", err)
+			os.Exit(1)
+		}
+		go serveReverse(r, rawaddr)
+	}
+
+	if config.RedirLocalAddr != "" {
+		log.Println("Redir is Listening:", network, config.RedirLocalAddr)
+		redirLn, err := net.Listen(network, config.RedirLocalAddr)
+		if err != nil {
+			log.Println("Listen Error", err)
+			os.Exit(1)
+		}
+		go serve(redirLn, handleRedir)
+	}
+
+	if config.TProxyLocalAddr != "" {
+		log.Println("TProxy is Listening:", config.TProxyLocalAddr)
+		tproxyLn, err := tnt.ListenTProxy(config.TProxyLocalAddr)
+		if err != nil {
+			log.Println("Listen Error", err)
+			os.Exit(1)
+		}
+		tproxyPC, err := tnt.ListenTProxyUDP(config.TProxyLocalAddr)
+		if err != nil {
+			log.Println("Listen Error", err)
+			os.Exit(1)
+		}
+		go serve(tproxyLn, handleTProxy)
+		go serveTProxyUDP(tproxyPC)
+	}
+
+	serve(ln, handleConn)
+}
+
+func serve(ln net.Listener, handler func(net.Conn)) {
 	for {
 		conn, err := ln.Accept()
 		if err != nil {
@@ -310,6 +706,6 @@ func main() {
 			continue
 		}
 
-		go handleConn(conn, cipher.Copy())
+		go handler(conn)
 	}
 }
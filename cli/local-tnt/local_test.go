@@ -0,0 +1,120 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/rockdragon/TNT/tnt"
+)
+
+func TestAuthenticate(t *testing.T) {
+	var err error
+	credentials, err = tnt.LoadCredentials(map[string]string{"alice": "secret", "b": "p"}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { credentials = nil }()
+
+	for _, c := range []struct {
+		username, password string
+		ok                 bool
+	}{
+		{"alice", "secret", true},
+		{"b", "p", true},
+		{"alice", "wrong", false},
+		{"alice", "", false},
+		{"mallory", "secret", false},
+	} {
+		client, server := net.Pipe()
+		done := make(chan error, 1)
+		go func() { done <- authenticate(server) }()
+
+		req := []byte{userPassVersion, byte(len(c.username))}
+		req = append(req, c.username...)
+		req = append(req, byte(len(c.password)))
+		req = append(req, c.password...)
+		if _, err = client.Write(req); err != nil {
+			t.Fatal(err)
+		}
+		rep := make([]byte, 2)
+		if _, err = client.Read(rep); err != nil {
+			t.Fatal(err)
+		}
+		err = <-done
+		client.Close()
+		server.Close()
+
+		if ok := rep[1] == 0x00; ok != c.ok || (err == nil) != c.ok {
+			t.Errorf("%s/%s: status %d, err %v", c.username, c.password, rep[1], err)
+		}
+	}
+}
+
+func TestUDPRouteRules(t *testing.T) {
+	directPC, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer directPC.Close()
+	rejectPC, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rejectPC.Close()
+
+	path := filepath.Join(t.TempDir(), "rules.txt")
+	rejectPort := rejectPC.LocalAddr().(*net.UDPAddr).Port
+	if err = os.WriteFile(path, []byte(fmt.Sprintf("DST-PORT,%d,reject\nFINAL,direct\n", rejectPort)), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if rules, err = tnt.LoadRules(path); err != nil {
+		t.Fatal(err)
+	}
+	defer func() { rules = nil }()
+
+	replies := make(chan string, 1)
+	route, err := newUDPRoute("", func(rawaddr, data []byte) {
+		host, _ := tnt.ParseRawAddr(rawaddr)
+		replies <- host + " " + string(data)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer route.Close()
+
+	for _, pc := range []net.PacketConn{rejectPC, directPC} {
+		rawaddr, err := tnt.AddrRawAddr(pc.LocalAddr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		route.send(rawaddr, []byte("ping"))
+	}
+
+	buf := make([]byte, 64)
+	directPC.SetReadDeadline(time.Now().Add(2 * time.Second))
+	n, from, err := directPC.ReadFrom(buf)
+	if err != nil || string(buf[:n]) != "ping" {
+		t.Fatalf("direct target got %q, %v", buf[:n], err)
+	}
+	rejectPC.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	if n, _, err = rejectPC.ReadFrom(buf); err == nil {
+		t.Fatalf("rejected target got %q", buf[:n])
+	}
+
+	// answer of direct target comes back
+	if _, err = directPC.WriteTo([]byte("pong"), from); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case got := <-replies:
+		if want := directPC.LocalAddr().String() + " pong"; got != want {
+			t.Fatalf("got %q, want %q", got, want)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("no answer")
+	}
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	tnt "github.com/rockdragon/TNT/tnt"
+)
+
+// rountine of iptables REDIRECTed connection
+func handleRedir(conn net.Conn) {
+	defer conn.Close()
+
+	dst, err := tnt.OriginalDst(conn)
+	if err != nil {
+		log.Println("[REDIR] original destination error", err)
+		return
+	}
+	redirect(conn, dst)
+}
+
+// rountine of TPROXY connection, whose LocalAddr is the original destination
+func handleTProxy(conn net.Conn) {
+	defer conn.Close()
+	redirect(conn, conn.LocalAddr().(*net.TCPAddr))
+}
+
+func redirect(conn net.Conn, dst *net.TCPAddr) {
+	log.Println("[REDIR]", conn.RemoteAddr(), "->", dst)
+	remote, rep, _, err := connectToServer(tnt.IPRawAddr(dst.IP, dst.Port))
+	if err != nil {
+		log.Println("Connect to target server failed", err)
+		return
+	}
+	if rep != tnt.RepSucceeded {
+		log.Println("[REP]", rep, dst)
+		return
+	}
+	relay(conn, remote)
+}
+
+// tproxyUDP datagrams of one client source through an udp association
+type tproxyUDP struct {
+	client *net.UDPAddr
+	route  *udpRoute
+
+	mu      sync.Mutex
+	senders map[string]*net.UDPConn // key of original destination
+}
+
+// serveTProxyUDP relay TPROXYed datagrams, replies are sent from
+// the original destinations.
+func serveTProxyUDP(pc *net.UDPConn) {
+	if tnt.TrafficVersion != tnt.TrafficVersion2 {
+		log.Println("[TPROXY UDP] requires traffic version", tnt.TrafficVersion2)
+		return
+	}
+	var mu sync.Mutex
+	clients := make(map[string]*tproxyUDP)
+
+	buf := make([]byte, 64*1024)
+	for {
+		n, src, dst, err := tnt.ReadFromUDPWithDst(pc, buf)
+		if err != nil {
+			log.Println("[TPROXY UDP] read error", err)
+			if err == tnt.ErrBadAddr {
+				continue
+			}
+			return
+		}
+
+		key := src.String()
+		mu.Lock()
+		t := clients[key]
+		if t == nil {
+			t = &tproxyUDP{client: src, senders: make(map[string]*net.UDPConn)}
+			if t.route, err = newUDPRoute(dst.IP.String(), t.reply); err != nil {
+				mu.Unlock()
+				log.Println("[TPROXY UDP] listen error", err)
+				continue
+			}
+			clients[key] = t
+			go func() {
+				t.expire()
+				mu.Lock()
+				delete(clients, key)
+				mu.Unlock()
+			}()
+		}
+		mu.Unlock()
+
+		t.route.send(tnt.IPRawAddr(dst.IP, dst.Port), buf[:n])
+	}
+}
+
+// expire association after UDPTimeout idle
+func (t *tproxyUDP) expire() {
+	defer func() {
+		t.route.Close()
+		t.mu.Lock()
+		for _, s := range t.senders {
+			s.Close()
+		}
+		t.mu.Unlock()
+	}()
+
+	ticker := time.NewTicker(tnt.UDPTimeout / 2)
+	defer ticker.Stop()
+	for range ticker.C {
+		if t.route.idle() > tnt.UDPTimeout {
+			return
+		}
+	}
+}
+
+// reply send data to client from the original destination rawaddr
+func (t *tproxyUDP) reply(rawaddr, data []byte) {
+	host, err := tnt.ParseRawAddr(rawaddr)
+	if err != nil {
+		return
+	}
+	from, err := net.ResolveUDPAddr("udp", host)
+	if err != nil {
+		return
+	}
+
+	t.mu.Lock()
+	sender := t.senders[host]
+	if sender == nil {
+		if sender, err = tnt.DialUDPFrom(from, t.client); err != nil {
+			t.mu.Unlock()
+			log.Println("[TPROXY UDP] reply socket error", err)
+			return
+		}
+		t.senders[host] = sender
+	}
+	t.mu.Unlock()
+	sender.Write(data)
+}
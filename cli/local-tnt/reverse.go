@@ -0,0 +1,33 @@
+package main
+
+import (
+	"log"
+	"time"
+
+	tnt "github.com/rockdragon/TNT/tnt"
+)
+
+// delay before registering a reverse tunnel again
+const reverseRetry = 5 * time.Second
+
+// serveReverse keep a reverse tunnel registered on server, connect the
+// inbound connections to r.Local.
+func serveReverse(r *tnt.Reverse, rawaddr []byte) {
+	for {
+		u := servers.pick(r.Remote, nil)
+		session, rep, bound, err := tnt.DialReverse(network, u.addr, rawaddr, u.cipher.Copy())
+		switch {
+		case err != nil:
+			log.Println("[REVERSE] connect to server failed", err)
+			u.setAlive(false, 0)
+		case rep != tnt.RepSucceeded:
+			log.Println("[REP]", rep, r.Remote)
+		default:
+			remote, _ := tnt.ParseRawAddr(bound)
+			log.Println("[REVERSE] Listening:", remote, "->", r.Local)
+			tnt.ReverseStreams(session, network, r.Local)
+			log.Println("[REVERSE] session closed", r.Remote)
+		}
+		time.Sleep(reverseRetry)
+	}
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strconv"
+
+	tnt "github.com/rockdragon/TNT/tnt"
+)
+
+const (
+	socks4Version = 4
+	socks4Connect = 1
+
+	socks4Granted  = 90
+	socks4Rejected = 91
+
+	maxSocks4Field = 255
+)
+
+// socks4Request
+// +----+----+----+----+----+----+----+----+----+----+....+----+
+// | VN | CD | DSTPORT |      DSTIP        | USERID       |NULL|
+// +----+----+----+----+----+----+----+----+----+----+....+----+
+// | 1  | 1  |    2    |         4         | variable     | 1  |
+// SOCKS4a sets DSTIP to 0.0.0.x, the domain follows with a NULL.
+type socks4Request struct {
+	Command         uint8
+	UserID          string
+	AddressWithPort string
+	RawAddr         []byte
+}
+
+func (r *socks4Request) String() string {
+	return fmt.Sprintf("[Socks4 Request] [Command:%d] [%s]", r.Command, r.AddressWithPort)
+}
+
+func extractSocks4Request(conn *peekConn) (req *socks4Request, err error) {
+	buf := make([]byte, 8)
+	if _, err = io.ReadFull(conn.r, buf); err != nil {
+		return
+	}
+	if buf[0] != socks4Version {
+		return nil, errors.New("NOT a socks4 request")
+	}
+	port := binary.BigEndian.Uint16(buf[2:4])
+	ip := net.IP(buf[4:8])
+
+	req = &socks4Request{Command: buf[1]}
+	if req.UserID, err = readNullTerminated(conn.r); err != nil {
+		return
+	}
+
+	if ip[0] == 0 && ip[1] == 0 && ip[2] == 0 && ip[3] != 0 {
+		// socks4a
+		domain, err := readNullTerminated(conn.r)
+		if err != nil {
+			return nil, err
+		}
+		req.RawAddr = tnt.RawAddr(domain, port)
+		req.AddressWithPort = net.JoinHostPort(domain, strconv.Itoa(int(port)))
+	} else {
+		req.RawAddr = tnt.IPRawAddr(ip, int(port))
+		req.AddressWithPort = net.JoinHostPort(ip.String(), strconv.Itoa(int(port)))
+	}
+	return
+}
+
+func readNullTerminated(r *bufio.Reader) (string, error) {
+	var field []byte
+	for {
+		b, err := r.ReadByte()
+		if err != nil {
+			return "", err
+		}
+		if b == 0 {
+			return string(field), nil
+		}
+		if len(field) == maxSocks4Field {
+			return "", errors.New("socks4 field too long")
+		}
+		field = append(field, b)
+	}
+}
+
+// replySocks4
+// +----+----+----+----+----+----+----+----+
+// | VN | CD | DSTPORT |      DSTIP        |
+// +----+----+----+----+----+----+----+----+
+// | 1  | 1  |    2    |         4         |
+func replySocks4(conn net.Conn, cd uint8) {
+	reply(conn, []byte{0x00, cd, 0, 0, 0, 0, 0, 0})
+}
+
+// rountine of socks4 connection
+func handleSocks4(conn *peekConn) {
+	req, err := extractSocks4Request(conn)
+	if err != nil {
+		log.Println("[Extract Request Error]", err)
+		return
+	}
+	log.Println(req)
+
+	if credentials != nil {
+		// socks4 has no password to verify
+		log.Println("[Auth Error] socks4 is not allowed with authentication")
+		replySocks4(conn, socks4Rejected)
+		return
+	}
+	if req.Command != socks4Connect {
+		log.Println("[Extract Request Error] only CONNECT be able to accept")
+		replySocks4(conn, socks4Rejected)
+		return
+	}
+
+	remote, rep, _, err := connectToServer(req.RawAddr)
+	if err != nil {
+		log.Println("Connect to target server failed", err)
+		replySocks4(conn, socks4Rejected)
+		return
+	}
+	if rep != tnt.RepSucceeded {
+		log.Println("[REP]", rep, req.AddressWithPort)
+		replySocks4(conn, socks4Rejected)
+		return
+	}
+	replySocks4(conn, socks4Granted)
+	relay(conn, remote)
+}
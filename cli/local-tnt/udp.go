@@ -0,0 +1,148 @@
+package main
+
+import (
+	"io"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	tnt "github.com/rockdragon/TNT/tnt"
+)
+
+// udpRoute datagrams of one association, each sent through tunnel,
+// directly or dropped as rules decide. Tunnel is dialed on the first
+// proxied datagram, and again once it expires.
+type udpRoute struct {
+	pick   string // host picking upstream
+	direct *net.UDPConn
+	reply  func(rawaddr, data []byte)
+
+	mu     sync.Mutex
+	tunnel *tnt.UDPTunnel
+	active time.Time
+	closed bool
+}
+
+func newUDPRoute(pick string, reply func(rawaddr, data []byte)) (*udpRoute, error) {
+	direct, err := net.ListenUDP("udp", nil)
+	if err != nil {
+		return nil, err
+	}
+	r := &udpRoute{pick: pick, direct: direct, reply: reply, active: time.Now()}
+	go r.serveDirect()
+	return r, nil
+}
+
+// send data to rawaddr, failures are logged and the datagram dropped
+func (r *udpRoute) send(rawaddr, data []byte) {
+	r.touch()
+	if rules != nil {
+		host, err := tnt.ParseRawAddr(rawaddr)
+		if err != nil {
+			return
+		}
+		switch action := rules.Match(host); action {
+		case tnt.ActionReject:
+			log.Println("[RULES]", action, host)
+			return
+		case tnt.ActionDirect:
+			addr, err := net.ResolveUDPAddr("udp", host)
+			if err != nil {
+				log.Println("[DIRECT] resolve error", err)
+				return
+			}
+			if _, err = r.direct.WriteToUDP(data, addr); err != nil {
+				log.Println("[DIRECT] write error", err)
+			}
+			return
+		}
+	}
+
+	tunnel, err := r.dialTunnel()
+	if err != nil {
+		log.Println("Connect to target server failed", err)
+		return
+	}
+	if err = tunnel.WriteTo(rawaddr, data); err != nil && err != tnt.ErrPayloadTooLarge {
+		log.Println("[UDP] write error", err)
+		tunnel.Close()
+	}
+}
+
+// dialTunnel tunnel of association, dialed if there is none
+func (r *udpRoute) dialTunnel() (*tnt.UDPTunnel, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.closed {
+		return nil, io.ErrClosedPipe
+	}
+	if r.tunnel == nil {
+		u := servers.pick(r.pick, nil)
+		if u == nil {
+			return nil, errNoUpstream
+		}
+		tunnel, err := tnt.DialUDPTunnel(network, u.addr, u.cipher.Copy())
+		if err != nil {
+			return nil, err
+		}
+		r.tunnel = tunnel
+		go r.serveTunnel(tunnel)
+	}
+	return r.tunnel, nil
+}
+
+func (r *udpRoute) serveTunnel(tunnel *tnt.UDPTunnel) {
+	defer func() {
+		tunnel.Close()
+		r.mu.Lock()
+		if r.tunnel == tunnel {
+			r.tunnel = nil
+		}
+		r.mu.Unlock()
+	}()
+	for {
+		rawaddr, data, err := tunnel.ReadFrom()
+		if err != nil {
+			return
+		}
+		r.touch()
+		r.reply(rawaddr, data)
+	}
+}
+
+func (r *udpRoute) serveDirect() {
+	buf := make([]byte, 64*1024)
+	for {
+		n, from, err := r.direct.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		r.touch()
+		r.reply(tnt.AddrOf(from), buf[:n])
+	}
+}
+
+func (r *udpRoute) touch() {
+	r.mu.Lock()
+	r.active = time.Now()
+	r.mu.Unlock()
+}
+
+// idle time since the last datagram either way
+func (r *udpRoute) idle() time.Duration {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return time.Since(r.active)
+}
+
+func (r *udpRoute) Close() error {
+	r.mu.Lock()
+	r.closed = true
+	tunnel := r.tunnel
+	r.mu.Unlock()
+	if tunnel != nil {
+		tunnel.Close()
+	}
+	return r.direct.Close()
+}
@@ -1,7 +1,6 @@
 package main
 
 import (
-	"encoding/binary"
 	"flag"
 	"fmt"
 	"log"
@@ -9,72 +8,51 @@ import (
 	"net"
 	"os"
 	"strconv"
+	"strings"
 	"time"
 
 	tnt "github.com/rockdragon/TNT/tnt"
 )
 
 const (
-	network    = "tcp"
-	requestBuf = 269
-
-	layoutATYP = 0
-	layoutIP   = 1
-	layoutAddr = 1
-
-	typeIPv4   = uint8(1)                // type is ipv4 address
-	typeDomain = uint8(3)                // type is domain address
-	typeIPv6   = uint8(4)                // type is ipv6 address
-	lenIPv4    = 3 + 1 + net.IPv4len + 2 // 3(ver+cmd+rsv) + 1addrType + ipv4 + 2port
-	lenIPv6    = 3 + 1 + net.IPv6len + 2 // 3(ver+cmd+rsv) + 1addrType + ipv6 + 2port
-	lenDmBase  = 3 + 1 + 1 + 2           // 3 + 1addrType + 1addrLen + 2port, plus addrLen
+	network = "tcp"
 )
 
 var (
-	config     *tnt.Config
-	errNS      error
-	presetAddr string
+	config       *tnt.Config
+	errNS        error
+	presetAddr   string
+	replayFilter *tnt.ReplayFilter
+	keyring      *tnt.Keyring
+	forwardAllow *tnt.Allowlist
+	reverseAllow *tnt.Allowlist
 )
 
 func init() {
 	rand.Seed(time.Now().Unix())
 }
 
-func extractRequest(conn *tnt.Conn) (host string, err error) {
+func extractTraffic(conn *tnt.Conn) (traffic *tnt.Traffic, err error) {
 	conn.SetReadTimeout()
 
-	traffic, err := tnt.UnMarshalTraffic(conn)
+	traffic, err = tnt.UnMarshalTraffic(conn)
 	if err != nil {
 		return
 	}
 
-	log.Println("[Traffic Type]", traffic.Type)
-	buf := traffic.Payload
-	ATYP := uint8(buf[layoutATYP])
-	var address string
-	var addrEnd int
-
-	switch ATYP {
-	case typeIPv4:
-		addrEnd = layoutAddr + lenIPv4
-		address = net.IP(buf[layoutAddr:addrEnd]).String()
-	case typeIPv6:
-		addrEnd = layoutAddr + lenIPv6
-		address = net.IP(buf[layoutAddr:addrEnd]).String()
-	case typeDomain:
-		addrLen := int(buf[layoutAddr])
-		addrEnd = layoutAddr + 1 + addrLen
-		address = string(buf[layoutAddr+1 : addrEnd])
-	default:
-		err = fmt.Errorf("address type is Unknown: %d", ATYP)
-		return
+	log.Println("[Traffic Type]", traffic.Version, traffic.Type)
+	// salts are forgotten after the window, only timestamps stop older replays
+	if traffic.Timestamp == 0 && config.RequireTimestamp {
+		return nil, tnt.ErrStaleTime
+	}
+	if traffic.Timestamp != 0 && !replayFilter.CheckTime(traffic.Timestamp) {
+		return nil, tnt.ErrStaleTime
 	}
-
-	port := binary.BigEndian.Uint16(buf[addrEnd : addrEnd+2])
-	host = net.JoinHostPort(address, strconv.Itoa(int(port)))
 	return
 }
 
+// respondWithHTTP act as the fake target, on the raw connection
+// so a probe cannot tell it from the real one.
 func respondWithHTTP(conn *tnt.Conn) {
 	remote, err := net.Dial(network, presetAddr)
 	if err != nil {
@@ -83,37 +61,236 @@ func respondWithHTTP(conn *tnt.Conn) {
 	}
 	defer remote.Close()
 
-	go tnt.Pipe(conn, remote)
-	tnt.Pipe(remote, conn)
+	go tnt.Pipe(conn.Conn, remote)
+	tnt.Pipe(remote, conn.Conn)
 }
 
 func handleConn(conn *tnt.Conn) {
 	defer conn.Close()
 
+	// 0. establish session key
+	if config.Handshake == tnt.HandshakeX25519 {
+		conn.SetReadTimeout()
+		var err error
+		if conn.Keyring != nil {
+			err = tnt.ServerHandshakeKeyring(conn, replayFilter)
+		} else {
+			var cipher *tnt.Cipher
+			if cipher, err = tnt.ServerHandshake(conn.Conn, conn.Cipher, replayFilter); err == nil {
+				conn.Cipher = cipher
+			}
+		}
+		if err != nil {
+			log.Println("Handshake Error", err)
+			respondWithHTTP(conn)
+			return
+		}
+	}
+
 	// 1. extract host info
-	host, err := extractRequest(conn)
+	traffic, err := extractTraffic(conn)
 	if err != nil {
 		log.Println("Extract Request Error", err)
 		respondWithHTTP(conn)
 		return
 	}
-	log.Println("[HOST]", host)
+	switch traffic.Type {
+	case tnt.TrafficMux:
+		conn.SetReadDeadline(time.Time{})
+		serveSession(tnt.NewSession(conn, false), conn.User)
+		return
+	case tnt.TrafficBind:
+		handleBind(conn, traffic.Payload)
+		return
+	case tnt.TrafficReverse:
+		handleReverse(conn, traffic.Payload)
+		return
+	case tnt.TrafficUDPAssociate:
+		log.Println("[UDP ASSOCIATE]", conn.User)
+		conn.SetReadDeadline(time.Time{})
+		tnt.ServeUDP(conn, allowed)
+		return
+	}
+	host, err := tnt.ParseRawAddr(traffic.Payload)
+	if err != nil {
+		log.Println("Extract Request Error", err)
+		respondWithHTTP(conn)
+		return
+	}
+	log.Println("[HOST]", conn.User, host)
 
 	// 2. request to the remote
-	remote, err := net.Dial(network, host)
+	wantReply := traffic.Flags&tnt.FlagReply != 0
+	remote, err := dial(host)
 	if err != nil {
 		log.Println("Request Remote Error", err)
-		respondWithHTTP(conn)
+		if wantReply {
+			tnt.WriteReply(conn, tnt.DialRep(err), tnt.IPRawAddr(net.IPv4zero, 0))
+		} else {
+			respondWithHTTP(conn)
+		}
+		return
+	}
+	defer remote.Close()
+
+	// 3. report the dial result
+	if wantReply {
+		if err = tnt.WriteReply(conn, tnt.RepSucceeded, tnt.AddrOf(remote.LocalAddr())); err != nil {
+			return
+		}
+	}
+
+	go tnt.Pipe(conn, remote)
+	tnt.Pipe(remote, conn)
+}
+
+// handleBind listen for one inbound connection on behalf of client,
+// expected peer is given by rawaddr.
+func handleBind(conn *tnt.Conn, rawaddr []byte) {
+	expected, err := tnt.ParseRawAddr(rawaddr)
+	if err != nil {
+		log.Println("Extract Request Error", err)
 		return
 	}
+	expectedIP, _, _ := net.SplitHostPort(expected)
+
+	// tunnel may run over a transport other than tcp
+	var localIP net.IP
+	if host, _, err := net.SplitHostPort(conn.LocalAddr().String()); err == nil {
+		localIP = net.ParseIP(host)
+	}
+	ln, err := net.ListenTCP(network, &net.TCPAddr{IP: localIP})
+	if err != nil {
+		log.Println("[BIND] listen error", err)
+		tnt.WriteReply(conn, tnt.RepServerFailure, tnt.IPRawAddr(net.IPv4zero, 0))
+		return
+	}
+	defer ln.Close()
+	log.Println("[BIND]", conn.User, ln.Addr(), "for", expected)
+	if err = tnt.WriteReply(conn, tnt.RepSucceeded, tnt.AddrOf(ln.Addr())); err != nil {
+		return
+	}
+
+	ln.SetDeadline(time.Now().Add(tnt.ReadTimeout))
+	var remote net.Conn
+	for remote == nil {
+		c, err := ln.Accept()
+		if err != nil {
+			log.Println("[BIND] accept error", err)
+			tnt.WriteReply(conn, tnt.RepTTLExpired, tnt.IPRawAddr(net.IPv4zero, 0))
+			return
+		}
+		peerIP := c.RemoteAddr().(*net.TCPAddr).IP
+		if ip := net.ParseIP(expectedIP); ip != nil && !ip.IsUnspecified() && !ip.Equal(peerIP) {
+			log.Println("[BIND] unexpected peer", c.RemoteAddr())
+			c.Close()
+			continue
+		}
+		remote = c
+	}
 	defer remote.Close()
 
+	if err = tnt.WriteReply(conn, tnt.RepSucceeded, tnt.AddrOf(remote.RemoteAddr())); err != nil {
+		return
+	}
 	go tnt.Pipe(conn, remote)
 	tnt.Pipe(remote, conn)
 }
 
+// handleReverse listen on rawaddr for client, reverse tunnels are
+// refused unless allowed by reverse_allow.
+func handleReverse(conn *tnt.Conn, rawaddr []byte) {
+	addr, err := tnt.ParseRawAddr(rawaddr)
+	if err != nil {
+		log.Println("Extract Request Error", err)
+		return
+	}
+	if reverseAllow == nil || !reverseAllow.Allow(addr) {
+		log.Println("[REVERSE] not allowed", conn.User, addr)
+		tnt.WriteReply(conn, tnt.RepNotAllowed, tnt.IPRawAddr(net.IPv4zero, 0))
+		return
+	}
+	ln, err := net.Listen(network, addr)
+	if err != nil {
+		log.Println("[REVERSE] listen error", err)
+		tnt.WriteReply(conn, tnt.RepServerFailure, tnt.IPRawAddr(net.IPv4zero, 0))
+		return
+	}
+	defer ln.Close()
+	log.Println("[REVERSE]", conn.User, ln.Addr())
+	if err = tnt.WriteReply(conn, tnt.RepSucceeded, tnt.AddrOf(ln.Addr())); err != nil {
+		return
+	}
+	conn.SetReadDeadline(time.Time{})
+	tnt.ServeReverse(conn, ln)
+}
+
+// serveSession accept streams until the session closed
+func serveSession(session *tnt.Session, user string) {
+	defer session.Close()
+	for {
+		stream, err := session.Accept()
+		if err != nil {
+			return
+		}
+		go handleStream(stream, user)
+	}
+}
+
+func handleStream(stream *tnt.Stream, user string) {
+	defer stream.Close()
+
+	host, err := tnt.ParseRawAddr(stream.Target)
+	if err != nil {
+		log.Println("Extract Request Error", err)
+		if stream.WantReply {
+			tnt.WriteReply(stream, tnt.RepAddrNotSupported, tnt.IPRawAddr(net.IPv4zero, 0))
+		}
+		return
+	}
+	log.Println("[HOST]", user, host)
+
+	remote, err := dial(host)
+	if stream.WantReply {
+		bound := tnt.IPRawAddr(net.IPv4zero, 0)
+		if err == nil {
+			bound = tnt.AddrOf(remote.LocalAddr())
+		}
+		tnt.WriteReply(stream, tnt.DialRep(err), bound)
+	}
+	if err != nil {
+		log.Println("Request Remote Error", err)
+		return
+	}
+	defer remote.Close()
+
+	go tnt.Pipe(stream, remote)
+	tnt.Pipe(remote, stream)
+}
+
+// allowed whether host is in allowlist if any, whatever the client claims
+// in flags, for tcp and udp alike
+func allowed(host string) bool {
+	return forwardAllow == nil || forwardAllow.Allow(host)
+}
+
+// dial the target if allowed
+func dial(host string) (net.Conn, error) {
+	if !allowed(host) {
+		return nil, tnt.ErrNotAllowed
+	}
+	return net.Dial(network, host)
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "Usage of %s:\n", os.Args[0])
+	flag.PrintDefaults()
+	fmt.Fprintf(os.Stderr, "Supported methods:\n  %s\n", strings.Join(tnt.ListCiphers(), "\n  "))
+}
+
 func main() {
 	cfgfile := flag.String("c", "config.json", "config file path")
+	flag.Usage = usage
 	flag.Parse()
 
 	config, errNS = tnt.ParseConfig(*cfgfile)
@@ -124,14 +301,46 @@ func main() {
 	log.Println("[CONF]", config)
 
 	presetAddr = net.JoinHostPort(config.TargetDomain, strconv.Itoa(int(config.TargetPort)))
+	replayFilter = tnt.NewReplayFilter(time.Duration(config.ReplayWindow) * time.Second)
+	if !config.RequireTimestamp && config.Handshake == tnt.HandshakeNone {
+		log.Println("[CONF] require_timestamp is off, connections recorded may be replayed after replay_window")
+	}
+	if len(config.ForwardAllow) > 0 {
+		if forwardAllow, errNS = tnt.NewAllowlist(config.ForwardAllow); errNS != nil {
+			log.Println("Config Parse Error", errNS)
+			os.Exit(1)
+		}
+	}
+	if len(config.ReverseAllow) > 0 {
+		if reverseAllow, errNS = tnt.NewAllowlist(config.ReverseAllow); errNS != nil {
+			log.Println("Config Parse Error", errNS)
+			os.Exit(1)
+		}
+	}
 
 	log.Println("Server is Listening:", network, config.ServerAddr)
-	ln, err := net.Listen(network, config.ServerAddr)
+	ln, err := tnt.Listen(network, config.ServerAddr)
 	if err != nil {
 		log.Println("Listen Error", err)
 		os.Exit(1)
 	}
 	var cipher *tnt.Cipher
+	if len(config.Users) > 0 {
+		users := config.Users
+		if config.Password != "" {
+			users = append(users, &tnt.User{Name: "default", Password: config.Password})
+		}
+		keyring, err = tnt.NewKeyring(config.Method, users, config.KDFOf(config.Method))
+		if err != nil {
+			log.Println("Generate Keyring Error", err)
+			os.Exit(1)
+		}
+		cipher = keyring.Cipher()
+		if !cipher.IsAEAD() && config.Handshake == tnt.HandshakeNone {
+			log.Println("Multiple users require AEAD method or handshake")
+			os.Exit(1)
+		}
+	}
 	for {
 		conn, err := ln.Accept()
 		if err != nil {
@@ -139,7 +348,7 @@ func main() {
 			return
 		}
 		if cipher == nil {
-			cipher, err = tnt.NewCipher(config.Method, config.Password)
+			cipher, err = tnt.NewCipherWithKDF(config.Method, config.Password, config.KDFOf(config.Method))
 			if err != nil {
 				log.Println("Generate Cipher Error", err)
 				conn.Close()
@@ -147,6 +356,9 @@ func main() {
 			}
 		}
 
-		go handleConn(tnt.NewConn(conn, cipher.Copy()))
+		c := tnt.NewConn(conn, cipher.Copy())
+		c.Replay = replayFilter
+		c.Keyring = keyring
+		go handleConn(c)
 	}
 }
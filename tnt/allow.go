@@ -0,0 +1,90 @@
+package tnt
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// Forward static port forwarding, like ssh -L
+type Forward struct {
+	Local  string `json:"local"`
+	Target string `json:"target"`
+}
+
+type allowEntry struct {
+	ipnet *net.IPNet
+	host  string // exact host, suffix if begins with ".", "" for any host
+	port  string // "" for any port
+}
+
+// Allowlist targets allowed to be forwarded, entries are "host[:port]",
+// host is either an IP, a CIDR, a domain, "*.domain" for subdomains,
+// or "*" for any host.
+type Allowlist struct {
+	entries []*allowEntry
+}
+
+// NewAllowlist parse entries
+func NewAllowlist(entries []string) (*Allowlist, error) {
+	a := new(Allowlist)
+	for _, e := range entries {
+		host, port, err := net.SplitHostPort(e)
+		if err != nil {
+			host, port = e, ""
+		}
+		if port == "*" {
+			port = ""
+		}
+		entry := &allowEntry{port: port}
+		switch {
+		case strings.Contains(host, "/"):
+			if _, entry.ipnet, err = net.ParseCIDR(host); err != nil {
+				return nil, fmt.Errorf("allowlist %s: %v", e, err)
+			}
+		case host == "*":
+		case strings.HasPrefix(host, "*."):
+			entry.host = strings.ToLower(host[1:])
+		default:
+			entry.host = strings.ToLower(host)
+		}
+		a.entries = append(a.entries, entry)
+	}
+	return a, nil
+}
+
+// Allow whether target host:port matches any entry
+func (a *Allowlist) Allow(target string) bool {
+	host, port, err := net.SplitHostPort(target)
+	if err != nil {
+		return false
+	}
+	host = strings.ToLower(host)
+	ip := net.ParseIP(host)
+	for _, e := range a.entries {
+		if e.port != "" && e.port != port {
+			continue
+		}
+		switch {
+		case e.ipnet == nil && e.host == "":
+			return true
+		case e.ipnet != nil:
+			if ip != nil && e.ipnet.Contains(ip) {
+				return true
+			}
+		case strings.HasPrefix(e.host, "."):
+			if strings.HasSuffix(host, e.host) {
+				return true
+			}
+		case ip != nil:
+			if eip := net.ParseIP(e.host); eip != nil && eip.Equal(ip) {
+				return true
+			}
+		default:
+			if host == e.host {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,53 @@
+package tnt
+
+import "testing"
+
+func TestAllowlist(t *testing.T) {
+	a, err := NewAllowlist([]string{
+		"db.internal:5432",
+		"*.corp.example.com:443",
+		"10.0.0.0/8:22",
+		"192.168.1.1",
+		"[::1]:8080",
+		"*:53",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []struct {
+		target string
+		ok     bool
+	}{
+		{"db.internal:5432", true},
+		{"DB.Internal:5432", true},
+		{"db.internal:5433", false},
+		{"x.db.internal:5432", false},
+		{"a.corp.example.com:443", true},
+		{"a.b.corp.example.com:443", true},
+		{"corp.example.com:443", false},
+		{"evilcorp.example.com:443", false},
+		{"a.corp.example.com:80", false},
+		{"10.1.2.3:22", true},
+		{"11.1.2.3:22", false},
+		{"10.1.2.3:23", false},
+		{"192.168.1.1:1", true},
+		{"192.168.1.2:1", false},
+		{"[::1]:8080", true},
+		{"[0:0::1]:8080", true},
+		{"[::1]:8081", false},
+		{"anything.example:53", true},
+		{"db.internal", false}, // no port
+	} {
+		if a.Allow(c.target) != c.ok {
+			t.Errorf("%s: %v", c.target, !c.ok)
+		}
+	}
+
+	if _, err = NewAllowlist([]string{"10.0.0.0/33"}); err == nil {
+		t.Error("malformed CIDR accepted")
+	}
+	empty, _ := NewAllowlist(nil)
+	if empty.Allow("127.0.0.1:80") {
+		t.Error("empty allowlist allows")
+	}
+}
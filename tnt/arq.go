@@ -0,0 +1,590 @@
+package tnt
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+)
+
+// ARQ reliable stream over unreliable packets, after the algorithm of KCP.
+// Every packet carries one or more segments:
+// | CONV | CMD | FRG | WND | TS | SN | UNA | LEN | DATA |
+// |  4   |  1  |  1  |  2  | 4  | 4  |  4  |  4  | LEN  |
+// integers are little endian. WND is the free receive window in segments,
+// UNA acknowledges every SN before it, TS is echoed by ACK for RTT.
+// FIN takes a SN like PUSH, so that the peer reads EOF after all data.
+// FRG is kept for compatibility of layout, always 0 as data is a stream.
+const (
+	arqCmdPush = uint8(81)
+	arqCmdAck  = uint8(82)
+	arqCmdWask = uint8(83) // ask for window size
+	arqCmdWins = uint8(84) // tell window size
+	arqCmdFin  = uint8(85)
+
+	arqAskSend = 1
+	arqAskTell = 2
+
+	arqOverhead   = 24
+	arqRTONoDelay = 30
+	arqRTOMin     = 100
+	arqRTODefault = 200
+	arqRTOMax     = 60000
+	arqThreshInit = 2
+	arqThreshMin  = 2
+	arqProbeInit  = 7000
+	arqProbeLimit = 120000
+	arqDeadLink   = 20
+)
+
+var errARQPacket = errors.New("malformed arq packet")
+
+type arqSegment struct {
+	cmd      uint8
+	wnd      uint16
+	ts       uint32
+	sn       uint32
+	una      uint32
+	data     []byte
+	resendts uint32
+	rto      uint32
+	fastack  uint32
+	xmit     uint32
+}
+
+func (s *arqSegment) encode(b []byte, conv uint32) []byte {
+	var h [arqOverhead]byte
+	binary.LittleEndian.PutUint32(h[0:], conv)
+	h[4] = s.cmd
+	binary.LittleEndian.PutUint16(h[6:], s.wnd)
+	binary.LittleEndian.PutUint32(h[8:], s.ts)
+	binary.LittleEndian.PutUint32(h[12:], s.sn)
+	binary.LittleEndian.PutUint32(h[16:], s.una)
+	binary.LittleEndian.PutUint32(h[20:], uint32(len(s.data)))
+	return append(append(b, h[:]...), s.data...)
+}
+
+type arqAck struct {
+	sn uint32
+	ts uint32
+}
+
+// arq state of one conversation, not safe for concurrent use.
+// current must be updated by caller before input and flush.
+type arq struct {
+	conv     uint32
+	mtu      uint32
+	mss      uint32
+	current  uint32
+	interval uint32
+
+	sndUna   uint32
+	sndNxt   uint32
+	rcvNxt   uint32
+	ssthresh uint32
+	rxRttvar int32
+	rxSrtt   int32
+	rxRto    uint32
+	rxMinrto uint32
+	sndWnd   uint32
+	rcvWnd   uint32
+	rmtWnd   uint32
+	cwnd     uint32
+	incr     uint32
+	probe    uint32
+
+	tsProbe   uint32
+	probeWait uint32
+
+	nodelay    bool
+	fastresend uint32
+	nocwnd     bool
+	dead       bool
+	finRecv    bool
+	routable   bool // peer echoed TS of a segment, so it does receive them
+	pad        bool // fill packets up to mtu with WINS
+
+	sndQueue []*arqSegment
+	sndBuf   []*arqSegment
+	rcvBuf   []*arqSegment
+	rcvQueue bytes.Buffer
+	ackList  []arqAck
+	buffer   []byte
+
+	output func(p []byte)
+}
+
+func newARQ(conv uint32, output func(p []byte)) *arq {
+	a := &arq{
+		conv:     conv,
+		sndWnd:   32,
+		rcvWnd:   128,
+		rmtWnd:   128,
+		rxRto:    arqRTODefault,
+		rxMinrto: arqRTOMin,
+		interval: 100,
+		ssthresh: arqThreshInit,
+		output:   output,
+	}
+	a.setMTU(1400)
+	return a
+}
+
+func (a *arq) setMTU(mtu int) {
+	a.mtu = uint32(mtu)
+	a.mss = a.mtu - arqOverhead
+	a.buffer = make([]byte, 0, mtu)
+}
+
+func (a *arq) setWndSize(snd, rcv int) {
+	if snd > 0 {
+		a.sndWnd = uint32(snd)
+	}
+	if rcv > 0 {
+		a.rcvWnd = uint32(rcv)
+	}
+}
+
+// setNoDelay nodelay lower the minimal RTO and back off slower,
+// resend is the count of duplicated ACKs triggering fast resend,
+// nc disable congestion control.
+func (a *arq) setNoDelay(nodelay bool, interval, resend int, nc bool) {
+	a.nodelay = nodelay
+	a.rxMinrto = arqRTOMin
+	if nodelay {
+		a.rxMinrto = arqRTONoDelay
+	}
+	if interval > 0 {
+		a.interval = uint32(interval)
+	}
+	if resend > 0 {
+		a.fastresend = uint32(resend)
+	}
+	a.nocwnd = nc
+}
+
+func diff(later, earlier uint32) int32 {
+	return int32(later - earlier)
+}
+
+// send queue b as a stream, filling up the last segment first
+func (a *arq) send(b []byte) {
+	if n := len(a.sndQueue); n > 0 {
+		last := a.sndQueue[n-1]
+		if last.cmd == arqCmdPush && uint32(len(last.data)) < a.mss {
+			k := int(a.mss) - len(last.data)
+			if k > len(b) {
+				k = len(b)
+			}
+			last.data = append(last.data, b[:k]...)
+			b = b[k:]
+		}
+	}
+	for len(b) > 0 {
+		k := int(a.mss)
+		if k > len(b) {
+			k = len(b)
+		}
+		a.sndQueue = append(a.sndQueue, &arqSegment{cmd: arqCmdPush, data: append([]byte(nil), b[:k]...)})
+		b = b[k:]
+	}
+}
+
+// sendFin queue end of stream
+func (a *arq) sendFin() {
+	a.sndQueue = append(a.sndQueue, &arqSegment{cmd: arqCmdFin})
+}
+
+// waitSnd segments not yet acknowledged
+func (a *arq) waitSnd() int {
+	return len(a.sndBuf) + len(a.sndQueue)
+}
+
+func (a *arq) queuedSegs() uint32 {
+	return (uint32(a.rcvQueue.Len()) + a.mss - 1) / a.mss
+}
+
+func (a *arq) wndUnused() uint16 {
+	if q := a.queuedSegs(); q < a.rcvWnd {
+		return uint16(a.rcvWnd - q)
+	}
+	return 0
+}
+
+// recv read the in-order data
+func (a *arq) recv(b []byte) int {
+	full := a.queuedSegs() >= a.rcvWnd
+	n, _ := a.rcvQueue.Read(b)
+	a.moveReady()
+	if full && a.queuedSegs() < a.rcvWnd {
+		// tell peer the window is open again
+		a.probe |= arqAskTell
+	}
+	return n
+}
+
+// moveReady move in-order segments from rcvBuf to rcvQueue
+func (a *arq) moveReady() {
+	for len(a.rcvBuf) > 0 {
+		seg := a.rcvBuf[0]
+		if seg.sn != a.rcvNxt || a.queuedSegs() >= a.rcvWnd {
+			break
+		}
+		if seg.cmd == arqCmdFin {
+			a.finRecv = true
+		} else {
+			a.rcvQueue.Write(seg.data)
+		}
+		a.rcvBuf[0] = nil
+		a.rcvBuf = a.rcvBuf[1:]
+		a.rcvNxt++
+	}
+}
+
+func (a *arq) updateAck(rtt int32) {
+	if a.rxSrtt == 0 {
+		a.rxSrtt = rtt
+		a.rxRttvar = rtt / 2
+	} else {
+		delta := rtt - a.rxSrtt
+		if delta < 0 {
+			delta = -delta
+		}
+		a.rxRttvar = (3*a.rxRttvar + delta) / 4
+		a.rxSrtt = (7*a.rxSrtt + rtt) / 8
+		if a.rxSrtt < 1 {
+			a.rxSrtt = 1
+		}
+	}
+	rto := uint32(a.rxSrtt) + max32(a.interval, uint32(4*a.rxRttvar))
+	a.rxRto = bound32(a.rxMinrto, rto, arqRTOMax)
+}
+
+func (a *arq) shrinkBuf() {
+	if len(a.sndBuf) > 0 {
+		a.sndUna = a.sndBuf[0].sn
+	} else {
+		a.sndUna = a.sndNxt
+	}
+}
+
+func (a *arq) parseAck(sn uint32) {
+	if diff(sn, a.sndUna) < 0 || diff(sn, a.sndNxt) >= 0 {
+		return
+	}
+	for i, seg := range a.sndBuf {
+		if sn == seg.sn {
+			a.sndBuf = append(a.sndBuf[:i], a.sndBuf[i+1:]...)
+			break
+		}
+		if diff(sn, seg.sn) < 0 {
+			break
+		}
+	}
+}
+
+// echoed whether ts is that of segment sn in flight
+func (a *arq) echoed(sn, ts uint32) bool {
+	for _, seg := range a.sndBuf {
+		if seg.sn == sn {
+			return seg.ts == ts
+		}
+	}
+	return false
+}
+
+func (a *arq) parseUna(una uint32) {
+	n := 0
+	for _, seg := range a.sndBuf {
+		if diff(una, seg.sn) <= 0 {
+			break
+		}
+		n++
+	}
+	a.sndBuf = a.sndBuf[n:]
+}
+
+func (a *arq) parseFastack(sn uint32) {
+	if diff(sn, a.sndUna) < 0 || diff(sn, a.sndNxt) >= 0 {
+		return
+	}
+	for _, seg := range a.sndBuf {
+		if diff(sn, seg.sn) < 0 {
+			break
+		}
+		if sn != seg.sn {
+			seg.fastack++
+		}
+	}
+}
+
+func (a *arq) parseData(seg *arqSegment) {
+	sn := seg.sn
+	if diff(sn, a.rcvNxt+a.rcvWnd) >= 0 || diff(sn, a.rcvNxt) < 0 {
+		return
+	}
+	i := len(a.rcvBuf)
+	for ; i > 0; i-- {
+		prev := a.rcvBuf[i-1]
+		if prev.sn == sn {
+			return
+		}
+		if diff(sn, prev.sn) > 0 {
+			break
+		}
+	}
+	a.rcvBuf = append(a.rcvBuf, nil)
+	copy(a.rcvBuf[i+1:], a.rcvBuf[i:])
+	a.rcvBuf[i] = seg
+	a.moveReady()
+}
+
+// input a packet from peer, regular unless recovered by FEC, whose late
+// arrival should neither be sampled for RTT nor acknowledged but by UNA
+func (a *arq) input(data []byte, regular bool) error {
+	prevUna := a.sndUna
+	var maxack uint32
+	var acked bool
+
+	for len(data) > 0 {
+		if len(data) < arqOverhead {
+			return errARQPacket
+		}
+		if binary.LittleEndian.Uint32(data) != a.conv {
+			return errARQPacket
+		}
+		cmd := data[4]
+		wnd := binary.LittleEndian.Uint16(data[6:])
+		ts := binary.LittleEndian.Uint32(data[8:])
+		sn := binary.LittleEndian.Uint32(data[12:])
+		una := binary.LittleEndian.Uint32(data[16:])
+		length := binary.LittleEndian.Uint32(data[20:])
+		data = data[arqOverhead:]
+		if uint32(len(data)) < length || cmd < arqCmdPush || cmd > arqCmdFin {
+			return errARQPacket
+		}
+
+		if cmd == arqCmdAck && !a.routable {
+			a.routable = a.echoed(sn, ts)
+		}
+		a.rmtWnd = uint32(wnd)
+		a.parseUna(una)
+		a.shrinkBuf()
+
+		switch cmd {
+		case arqCmdAck:
+			if rtt := diff(a.current, ts); rtt >= 0 && regular {
+				a.updateAck(rtt)
+			}
+			a.parseAck(sn)
+			a.shrinkBuf()
+			if !acked || diff(sn, maxack) > 0 {
+				acked, maxack = true, sn
+			}
+		case arqCmdPush, arqCmdFin:
+			if diff(sn, a.rcvNxt+a.rcvWnd) < 0 {
+				if regular {
+					a.ackList = append(a.ackList, arqAck{sn: sn, ts: ts})
+				}
+				if diff(sn, a.rcvNxt) >= 0 {
+					a.parseData(&arqSegment{
+						cmd:  cmd,
+						sn:   sn,
+						data: append([]byte(nil), data[:length]...),
+					})
+				}
+			}
+		case arqCmdWask:
+			a.probe |= arqAskTell
+		case arqCmdWins:
+		}
+		data = data[length:]
+	}
+
+	if acked {
+		a.parseFastack(maxack)
+	}
+
+	// congestion window grows as acknowledged
+	if diff(a.sndUna, prevUna) > 0 && a.cwnd < a.rmtWnd {
+		mss := a.mss
+		if a.cwnd < a.ssthresh {
+			a.cwnd++
+			a.incr += mss
+		} else {
+			if a.incr < mss {
+				a.incr = mss
+			}
+			a.incr += (mss*mss)/a.incr + mss/16
+			if (a.cwnd+1)*mss <= a.incr {
+				a.cwnd = (a.incr + mss - 1) / mss
+			}
+		}
+		if a.cwnd > a.rmtWnd {
+			a.cwnd = a.rmtWnd
+			a.incr = a.rmtWnd * mss
+		}
+	}
+	return nil
+}
+
+// flush send pending ACKs, window probes, new and timed out segments
+func (a *arq) flush(ackOnly bool) {
+	current := a.current
+	buf := a.buffer[:0]
+	emit := func(seg *arqSegment) {
+		if len(buf)+arqOverhead+len(seg.data) > int(a.mtu) && len(buf) > 0 {
+			a.write(buf)
+			buf = a.buffer[:0]
+		}
+		buf = seg.encode(buf, a.conv)
+	}
+
+	ack := &arqSegment{cmd: arqCmdAck, wnd: a.wndUnused(), una: a.rcvNxt}
+	for _, k := range a.ackList {
+		ack.sn, ack.ts = k.sn, k.ts
+		emit(ack)
+	}
+	a.ackList = a.ackList[:0]
+
+	if ackOnly {
+		if len(buf) > 0 {
+			a.write(buf)
+		}
+		return
+	}
+
+	// probe window size if remote has no room
+	if a.rmtWnd == 0 {
+		if a.probeWait == 0 {
+			a.probeWait = arqProbeInit
+			a.tsProbe = current + a.probeWait
+		} else if diff(current, a.tsProbe) >= 0 {
+			if a.probeWait < arqProbeInit {
+				a.probeWait = arqProbeInit
+			}
+			a.probeWait += a.probeWait / 2
+			if a.probeWait > arqProbeLimit {
+				a.probeWait = arqProbeLimit
+			}
+			a.tsProbe = current + a.probeWait
+			a.probe |= arqAskSend
+		}
+	} else {
+		a.tsProbe = 0
+		a.probeWait = 0
+	}
+	if a.probe&arqAskSend != 0 {
+		emit(&arqSegment{cmd: arqCmdWask, wnd: ack.wnd, una: a.rcvNxt})
+	}
+	if a.probe&arqAskTell != 0 {
+		emit(&arqSegment{cmd: arqCmdWins, wnd: ack.wnd, una: a.rcvNxt})
+	}
+	a.probe = 0
+
+	cwnd := min32(a.sndWnd, a.rmtWnd)
+	if !a.nocwnd {
+		cwnd = min32(a.cwnd, cwnd)
+	}
+	for len(a.sndQueue) > 0 && diff(a.sndNxt, a.sndUna+cwnd) < 0 {
+		seg := a.sndQueue[0]
+		a.sndQueue[0] = nil
+		a.sndQueue = a.sndQueue[1:]
+		seg.sn = a.sndNxt
+		a.sndNxt++
+		a.sndBuf = append(a.sndBuf, seg)
+	}
+
+	resent := a.fastresend
+	if resent == 0 {
+		resent = 0xffffffff
+	}
+	var rtomin uint32
+	if !a.nodelay {
+		rtomin = a.rxRto >> 3
+	}
+
+	var change, lost bool
+	for _, seg := range a.sndBuf {
+		send := false
+		switch {
+		case seg.xmit == 0:
+			send = true
+			seg.rto = a.rxRto
+			seg.resendts = current + seg.rto + rtomin
+		case diff(current, seg.resendts) >= 0:
+			send = true
+			if a.nodelay {
+				seg.rto += seg.rto / 2
+			} else {
+				seg.rto += max32(seg.rto, a.rxRto)
+			}
+			seg.rto = min32(seg.rto, arqRTOMax)
+			seg.resendts = current + seg.rto
+			lost = true
+		case seg.fastack >= resent:
+			send = true
+			seg.fastack = 0
+			seg.resendts = current + seg.rto
+			change = true
+		}
+		if send {
+			seg.xmit++
+			seg.ts = current
+			seg.wnd = ack.wnd
+			seg.una = a.rcvNxt
+			emit(seg)
+			if seg.xmit >= arqDeadLink {
+				a.dead = true
+			}
+		}
+	}
+	if len(buf) > 0 {
+		a.write(buf)
+	}
+
+	if change {
+		a.ssthresh = max32((a.sndNxt-a.sndUna)/2, arqThreshMin)
+		a.cwnd = a.ssthresh + resent
+		a.incr = a.cwnd * a.mss
+	}
+	if lost {
+		a.ssthresh = max32(cwnd/2, arqThreshMin)
+		a.cwnd = 1
+		a.incr = a.mss
+	}
+	if a.cwnd < 1 {
+		a.cwnd = 1
+		a.incr = a.mss
+	}
+}
+
+// write output buf, padded if asked to
+func (a *arq) write(buf []byte) {
+	if a.pad && len(buf)+arqOverhead <= int(a.mtu) {
+		buf = (&arqSegment{
+			cmd:  arqCmdWins,
+			wnd:  a.wndUnused(),
+			una:  a.rcvNxt,
+			data: make([]byte, int(a.mtu)-len(buf)-arqOverhead),
+		}).encode(buf, a.conv)
+	}
+	a.output(buf)
+}
+
+func min32(a, b uint32) uint32 {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func max32(a, b uint32) uint32 {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+func bound32(lower, v, upper uint32) uint32 {
+	return min32(max32(lower, v), upper)
+}
@@ -0,0 +1,184 @@
+package tnt
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+)
+
+// arqLink one direction of a simulated link, which drops, duplicates and
+// reorders packets
+type arqLink struct {
+	rnd   *rand.Rand
+	loss  float64
+	dup   float64
+	queue [][]byte
+}
+
+func (l *arqLink) output(p []byte) {
+	if l.rnd.Float64() < l.loss {
+		return
+	}
+	p = append([]byte(nil), p...)
+	l.queue = append(l.queue, p)
+	if l.rnd.Float64() < l.dup {
+		l.queue = append(l.queue, p)
+	}
+}
+
+func (l *arqLink) deliver(to *arq) {
+	q := l.queue
+	l.queue = nil
+	l.rnd.Shuffle(len(q), func(i, j int) { q[i], q[j] = q[j], q[i] })
+	for _, p := range q {
+		if err := to.input(p, true); err != nil {
+			panic(err)
+		}
+	}
+}
+
+// arqPair two arqs talking over simulated links, driven by a fake clock
+type arqPair struct {
+	a, b   *arq
+	ab, ba *arqLink
+	now    uint32
+}
+
+func newARQPair(seed int64, loss, dup float64, nodelay bool) *arqPair {
+	rnd := rand.New(rand.NewSource(seed))
+	p := &arqPair{
+		ab:  &arqLink{rnd: rnd, loss: loss, dup: dup},
+		ba:  &arqLink{rnd: rnd, loss: loss, dup: dup},
+		now: 0xfffff000, // clock wraps during the test
+	}
+	p.a = newARQ(1, p.ab.output)
+	p.b = newARQ(1, p.ba.output)
+	for _, a := range []*arq{p.a, p.b} {
+		a.setMTU(500)
+		a.setWndSize(64, 128)
+		if nodelay {
+			a.setNoDelay(true, 10, 2, true)
+		}
+	}
+	return p
+}
+
+func (p *arqPair) step() {
+	p.now += 10
+	p.a.current, p.b.current = p.now, p.now
+	p.a.flush(false)
+	p.b.flush(false)
+	p.ab.deliver(p.b)
+	p.ba.deliver(p.a)
+}
+
+func drain(a *arq, to *bytes.Buffer) {
+	buf := make([]byte, 4096)
+	for a.rcvQueue.Len() > 0 {
+		to.Write(buf[:a.recv(buf)])
+	}
+}
+
+func randBytes(rnd *rand.Rand, n int) []byte {
+	b := make([]byte, n)
+	rnd.Read(b)
+	return b
+}
+
+func TestARQLossReorderDuplicate(t *testing.T) {
+	for _, nodelay := range []bool{false, true} {
+		p := newARQPair(1, 0.2, 0.1, nodelay)
+		rnd := rand.New(rand.NewSource(2))
+		up, down := randBytes(rnd, 200000), randBytes(rnd, 150000)
+		p.a.send(up)
+		p.b.send(down)
+
+		var gotUp, gotDown bytes.Buffer
+		for i := 0; i < 100000 && (gotUp.Len() < len(up) || gotDown.Len() < len(down)); i++ {
+			p.step()
+			drain(p.b, &gotUp)
+			drain(p.a, &gotDown)
+		}
+		if !bytes.Equal(gotUp.Bytes(), up) || !bytes.Equal(gotDown.Bytes(), down) {
+			t.Fatalf("nodelay %v: got %d/%d up, %d/%d down",
+				nodelay, gotUp.Len(), len(up), gotDown.Len(), len(down))
+		}
+		if p.a.dead || p.b.dead {
+			t.Fatalf("nodelay %v: link dead", nodelay)
+		}
+	}
+}
+
+func TestARQFinAfterData(t *testing.T) {
+	for seed := int64(0); seed < 20; seed++ {
+		p := newARQPair(seed, 0.3, 0.1, true)
+		data := randBytes(rand.New(rand.NewSource(seed)), 20000)
+		p.a.send(data)
+		p.a.sendFin()
+
+		var got bytes.Buffer
+		for i := 0; i < 100000 && !p.b.finRecv; i++ {
+			p.step()
+			if p.b.finRecv && got.Len()+p.b.rcvQueue.Len() < len(data) {
+				t.Fatalf("seed %d: EOF after %d of %d bytes", seed, got.Len()+p.b.rcvQueue.Len(), len(data))
+			}
+			drain(p.b, &got)
+		}
+		if !p.b.finRecv || !bytes.Equal(got.Bytes(), data) {
+			t.Fatalf("seed %d: fin %v, got %d of %d bytes", seed, p.b.finRecv, got.Len(), len(data))
+		}
+		// FIN is acknowledged like data
+		for i := 0; i < 10000 && p.a.waitSnd() > 0; i++ {
+			p.step()
+		}
+		if p.a.waitSnd() > 0 {
+			t.Fatalf("seed %d: FIN never acknowledged", seed)
+		}
+	}
+}
+
+func TestARQDeadLink(t *testing.T) {
+	for _, nodelay := range []bool{false, true} {
+		p := newARQPair(1, 1, 0, nodelay)
+		p.a.send([]byte("lost"))
+		// 20 transmissions, each waiting arqRTOMax at most
+		for i := 0; i < arqDeadLink*arqRTOMax/10+1 && !p.a.dead; i++ {
+			p.step()
+			for _, seg := range p.a.sndBuf {
+				if seg.rto > arqRTOMax {
+					t.Fatalf("nodelay %v: rto %d above max", nodelay, seg.rto)
+				}
+			}
+		}
+		if !p.a.dead {
+			t.Fatalf("nodelay %v: link never dead", nodelay)
+		}
+	}
+}
+
+func TestARQRoutable(t *testing.T) {
+	p := newARQPair(1, 0, 0, true)
+	p.b.send([]byte("hello"))
+	p.now += 10
+	p.a.current, p.b.current = p.now, p.now
+	p.b.flush(false)
+	p.ba.deliver(p.a)
+	if p.b.routable {
+		t.Fatal("routable before peer acknowledged")
+	}
+
+	// an ACK of the right SN but a guessed TS proves nothing
+	seg := p.b.sndBuf[0]
+	forged := (&arqSegment{cmd: arqCmdAck, wnd: 128, sn: seg.sn, ts: seg.ts + 1}).encode(nil, 1)
+	p.b.input(forged, true)
+	if p.b.routable {
+		t.Fatal("forged ACK taken")
+	}
+
+	p.b.send([]byte("again"))
+	p.step()
+	p.step()
+	if !p.b.routable {
+		t.Fatal("echoed ACK not taken")
+	}
+}
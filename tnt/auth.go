@@ -0,0 +1,61 @@
+package tnt
+
+import (
+	"bufio"
+	"crypto/subtle"
+	"fmt"
+	"os"
+	"strings"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Credentials username/password of socks clients, passwords are
+// either plain text or bcrypt hashes as htpasswd -B generates.
+type Credentials struct {
+	users map[string]string
+}
+
+// LoadCredentials merge users with those in htpasswd-style file
+// of "username:password" lines
+func LoadCredentials(users map[string]string, file string) (*Credentials, error) {
+	c := &Credentials{users: make(map[string]string)}
+	for name, password := range users {
+		c.users[name] = password
+	}
+	if file == "" {
+		return c, nil
+	}
+
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		i := strings.IndexByte(line, ':')
+		if i <= 0 {
+			return nil, fmt.Errorf("%s:%d: malformed line", file, n)
+		}
+		c.users[line[:i]] = line[i+1:]
+	}
+	return c, scanner.Err()
+}
+
+// Verify username and password
+func (c *Credentials) Verify(username, password string) bool {
+	stored, ok := c.users[username]
+	if !ok {
+		return false
+	}
+	if strings.HasPrefix(stored, "$2a$") || strings.HasPrefix(stored, "$2b$") || strings.HasPrefix(stored, "$2y$") {
+		return bcrypt.CompareHashAndPassword([]byte(stored), []byte(password)) == nil
+	}
+	return subtle.ConstantTimeCompare([]byte(stored), []byte(password)) == 1
+}
@@ -0,0 +1,57 @@
+package tnt
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestCredentials(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("hashed"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file := filepath.Join(t.TempDir(), "htpasswd")
+	data := "# comment\n\nbob:" + string(hash) + "\ncarol:plain:with:colons\nalice:fromfile\n"
+	if err = os.WriteFile(file, []byte(data), 0600); err != nil {
+		t.Fatal(err)
+	}
+	c, err := LoadCredentials(map[string]string{"alice": "secret", "dave": "d"}, file)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, v := range []struct {
+		username, password string
+		ok                 bool
+	}{
+		{"alice", "fromfile", true}, // file takes precedence
+		{"alice", "secret", false},
+		{"bob", "hashed", true},
+		{"bob", string(hash), false},
+		{"carol", "plain:with:colons", true},
+		{"dave", "d", true},
+		{"dave", "", false},
+		{"", "", false},
+		{"eve", "d", false},
+	} {
+		if c.Verify(v.username, v.password) != v.ok {
+			t.Errorf("%s/%s: %v", v.username, v.password, !v.ok)
+		}
+	}
+}
+
+func TestCredentialsMalformed(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "htpasswd")
+	if err := os.WriteFile(file, []byte("alice:a\n:nobody\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadCredentials(nil, file); err == nil {
+		t.Fatal("malformed line accepted")
+	}
+	if _, err := LoadCredentials(nil, file+".missing"); err == nil {
+		t.Fatal("missing file accepted")
+	}
+}
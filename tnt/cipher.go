@@ -6,11 +6,16 @@ import (
 	"crypto/md5"
 	"crypto/rand"
 	"crypto/rc4"
+	"crypto/sha256"
 	"errors"
 	"fmt"
 	"io"
+	"sort"
+	"sync"
 
 	"github.com/Yawning/chacha20"
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/hkdf"
 )
 
 type DecOrEnc int
@@ -22,26 +27,94 @@ const (
 
 type cipherInfo struct {
 	keyLen    int
-	ivLen     int
+	ivLen     int // salt length for AEAD methods
 	newStream func(key, iv []byte, doe DecOrEnc) (cipher.Stream, error)
+	newAEAD   func(key []byte) (cipher.AEAD, error)
 }
 
 var (
+	cipherLock   sync.RWMutex
 	cipherMethod = map[string]*cipherInfo{
-		"aes-128-cfb":   {16, 16, newAESCFBStream},
-		"aes-192-cfb":   {24, 16, newAESCFBStream},
-		"aes-256-cfb":   {32, 16, newAESCFBStream},
-		"aes-128-ctr":   {16, 16, newAESCTRStream},
-		"aes-192-ctr":   {24, 16, newAESCTRStream},
-		"aes-256-ctr":   {32, 16, newAESCTRStream},
-		"rc4-md5":       {16, 16, newRC4MD5Stream},
-		"chacha20":      {32, 8, newChaCha20Stream},
-		"chacha20-ietf": {32, 12, newChaCha20IETFStream},
+		"aes-128-cfb":   {16, 16, newAESCFBStream, nil},
+		"aes-192-cfb":   {24, 16, newAESCFBStream, nil},
+		"aes-256-cfb":   {32, 16, newAESCFBStream, nil},
+		"aes-128-ctr":   {16, 16, newAESCTRStream, nil},
+		"aes-192-ctr":   {24, 16, newAESCTRStream, nil},
+		"aes-256-ctr":   {32, 16, newAESCTRStream, nil},
+		"rc4-md5":       {16, 16, newRC4MD5Stream, nil},
+		"chacha20":      {32, 8, newChaCha20Stream, nil},
+		"chacha20-ietf": {32, 12, newChaCha20IETFStream, nil},
+
+		"aes-128-gcm":             {16, 16, nil, newAESGCM},
+		"aes-256-gcm":             {32, 32, nil, newAESGCM},
+		"chacha20-ietf-poly1305":  {32, 32, nil, chacha20poly1305.New},
+		"xchacha20-ietf-poly1305": {32, 32, nil, chacha20poly1305.NewX},
 	}
 
 	errEmpty = errors.New("empty password")
+	errAuth  = errors.New("message authentication failed")
 )
 
+// AEAD chunk layout:
+// [encrypted payload length][length tag][encrypted payload][payload tag]
+const (
+	lenChunkSize = 2
+	maxChunkSize = 0x3FFF
+	subkeyInfo   = "ss-subkey"
+)
+
+// RegisterCipher add a stream cipher method, replace the existing one of the same name
+func RegisterCipher(name string, keyLen, ivLen int,
+	factory func(key, iv []byte, doe DecOrEnc) (cipher.Stream, error)) error {
+	if factory == nil || keyLen <= 0 || ivLen <= 0 {
+		return fmt.Errorf("invalid cipher method: %s", name)
+	}
+	cipherLock.Lock()
+	cipherMethod[name] = &cipherInfo{keyLen, ivLen, factory, nil}
+	cipherLock.Unlock()
+	return nil
+}
+
+// RegisterAEADCipher add an AEAD cipher method, replace the existing one of the same name.
+// factory is probed once, its nonce must fit in NonceSizeX.
+func RegisterAEADCipher(name string, keyLen, saltLen int,
+	factory func(key []byte) (cipher.AEAD, error)) error {
+	if factory == nil || keyLen <= 0 || saltLen <= 0 {
+		return fmt.Errorf("invalid cipher method: %s", name)
+	}
+	aead, err := factory(make([]byte, keyLen))
+	if err != nil {
+		return fmt.Errorf("cipher method %s: %v", name, err)
+	}
+	if aead.NonceSize() > chacha20poly1305.NonceSizeX {
+		return fmt.Errorf("cipher method %s: nonce size %d exceeds %d", name, aead.NonceSize(), chacha20poly1305.NonceSizeX)
+	}
+	cipherLock.Lock()
+	cipherMethod[name] = &cipherInfo{keyLen, saltLen, nil, factory}
+	cipherLock.Unlock()
+	return nil
+}
+
+// ListCiphers names of supported cipher methods, sorted
+func ListCiphers() []string {
+	cipherLock.RLock()
+	names := make([]string, 0, len(cipherMethod))
+	for name := range cipherMethod {
+		names = append(names, name)
+	}
+	cipherLock.RUnlock()
+	sort.Strings(names)
+	return names
+}
+
+// IsSupportedCipher whether method has been registered
+func IsSupportedCipher(method string) bool {
+	cipherLock.RLock()
+	_, ok := cipherMethod[method]
+	cipherLock.RUnlock()
+	return ok
+}
+
 func newAESCFBStream(key, iv []byte, doe DecOrEnc) (cipher.Stream, error) {
 	block, err := aes.NewCipher(key)
 	if err != nil {
@@ -74,6 +147,34 @@ func newChaCha20Stream(key, iv []byte, doe DecOrEnc) (cipher.Stream, error) {
 func newChaCha20IETFStream(key, iv []byte, doe DecOrEnc) (cipher.Stream, error) {
 	return chacha20.NewCipher(key, iv)
 }
+func newAESGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// subkey derive session key from master key and per-connection salt/IV,
+// so that master key is never used directly.
+func subkey(key, salt []byte) ([]byte, error) {
+	sub := make([]byte, len(key))
+	r := hkdf.New(sha256.New, key, salt, []byte(subkeyInfo))
+	if _, err := io.ReadFull(r, sub); err != nil {
+		return nil, err
+	}
+	return sub, nil
+}
+
+// increment nonce as little-endian counter
+func increment(b []byte) {
+	for i := range b {
+		b[i]++
+		if b[i] != 0 {
+			return
+		}
+	}
+}
 
 func md5sum(d []byte) []byte {
 	h := md5.New()
@@ -81,12 +182,15 @@ func md5sum(d []byte) []byte {
 	return h.Sum(nil)
 }
 
+// padKey legacy EVP_BytesToKey derivation, kept for stream methods
+// so that peers predating kdf stay compatible
 func padKey(password string, keyLen int) (key []byte) {
 	const md5Len = 16
 	cnt := (keyLen-1)/md5Len + 1
 	m := make([]byte, cnt*md5Len)
 	copy(m, md5sum([]byte(password)))
 
+	// password is never appended as prev is md5Len long, as released
 	prev := make([]byte, md5Len)
 	start := 0
 	for i := 1; i < cnt; i++ {
@@ -98,57 +202,143 @@ func padKey(password string, keyLen int) (key []byte) {
 	return m[:keyLen]
 }
 
-// NewCipher create new cipher
+// NewCipher create new cipher without kdf, which only stream methods
+// accept, with the legacy key
 func NewCipher(method, password string) (*Cipher, error) {
+	return NewCipherWithKDF(method, password, nil)
+}
+
+// NewCipherWithKDF create new cipher, master key derived by kdf.
+// Stream methods without kdf keep the legacy key and no subkeys, see
+// Config.KDFOf.
+func NewCipherWithKDF(method, password string, kdf *KDFConfig) (*Cipher, error) {
 	if password == "" {
 		return nil, errEmpty
 	}
+	cipherLock.RLock()
 	mi, ok := cipherMethod[method]
+	cipherLock.RUnlock()
 	if !ok {
 		return nil, fmt.Errorf("unsupported crypto method: %s", method)
 	}
-	key := padKey(password, mi.keyLen)
+	if kdf == nil && mi.newAEAD == nil {
+		return &Cipher{key: padKey(password, mi.keyLen), info: mi, legacy: true}, nil
+	}
+	key, err := deriveKey(password, mi.keyLen, kdf)
+	if err != nil {
+		return nil, err
+	}
 	c := &Cipher{key: key, info: mi}
 	return c, nil
 }
 
 // Cipher - crypto struct
 type Cipher struct {
-	enc  cipher.Stream
-	dec  cipher.Stream
-	key  []byte
-	info *cipherInfo
-	iv   []byte
+	enc      cipher.Stream
+	dec      cipher.Stream
+	aeadEnc  cipher.AEAD
+	aeadDec  cipher.AEAD
+	encNonce []byte
+	decNonce []byte
+	key      []byte
+	info     *cipherInfo
+	legacy   bool // master key used as is
+}
+
+// IsAEAD whether cipher method is authenticated
+func (c *Cipher) IsAEAD() bool {
+	return c.info.newAEAD != nil
+}
+
+// isAEADMethod whether method is a supported AEAD one
+func isAEADMethod(method string) bool {
+	cipherLock.RLock()
+	defer cipherLock.RUnlock()
+	mi, ok := cipherMethod[method]
+	return ok && mi.newAEAD != nil
+}
+
+func (c *Cipher) encReady() bool {
+	return c.enc != nil || c.aeadEnc != nil
+}
+func (c *Cipher) decReady() bool {
+	return c.dec != nil || c.aeadDec != nil
 }
 
 func (c *Cipher) initEncrpyt() (iv []byte, err error) {
-	if c.iv == nil {
-		iv = make([]byte, c.info.ivLen)
-		if _, err = io.ReadFull(rand.Reader, iv); err != nil {
-			return nil, err
-		}
-		c.iv = iv
-	} else {
-		iv = c.iv
+	// every direction of every session takes a fresh IV/salt
+	iv = make([]byte, c.info.ivLen)
+	if _, err = io.ReadFull(rand.Reader, iv); err != nil {
+		return nil, err
+	}
+	if c.IsAEAD() {
+		c.aeadEnc, err = c.newAEAD(iv)
+		c.encNonce = make([]byte, chacha20poly1305.NonceSizeX)
+		return
 	}
-	c.enc, err = c.info.newStream(c.key, iv, Encrypt)
+	key, err := c.streamKey(iv)
+	if err != nil {
+		return nil, err
+	}
+	c.enc, err = c.info.newStream(key, iv, Encrypt)
 	return
 }
 func (c *Cipher) initDecrpt(iv []byte) (err error) {
-	c.dec, err = c.info.newStream(c.key, iv, Decrypt)
+	if c.IsAEAD() {
+		c.aeadDec, err = c.newAEAD(iv)
+		c.decNonce = make([]byte, chacha20poly1305.NonceSizeX)
+		return
+	}
+	key, err := c.streamKey(iv)
+	if err != nil {
+		return
+	}
+	c.dec, err = c.info.newStream(key, iv, Decrypt)
 	return
 }
+func (c *Cipher) streamKey(iv []byte) ([]byte, error) {
+	if c.legacy {
+		return c.key, nil
+	}
+	return subkey(c.key, iv)
+}
+func (c *Cipher) newAEAD(salt []byte) (cipher.AEAD, error) {
+	key, err := subkey(c.key, salt)
+	if err != nil {
+		return nil, err
+	}
+	return c.info.newAEAD(key)
+}
 func (c *Cipher) encrypt(dst, src []byte) {
 	c.enc.XORKeyStream(dst, src)
 }
 func (c *Cipher) decrypt(dst, src []byte) {
 	c.dec.XORKeyStream(dst, src)
 }
+func (c *Cipher) seal(dst, plaintext []byte) []byte {
+	nonce := c.encNonce[:c.aeadEnc.NonceSize()]
+	dst = c.aeadEnc.Seal(dst, nonce, plaintext, nil)
+	increment(nonce)
+	return dst
+}
+func (c *Cipher) open(dst, ciphertext []byte) ([]byte, error) {
+	nonce := c.decNonce[:c.aeadDec.NonceSize()]
+	dst, err := c.aeadDec.Open(dst, nonce, ciphertext, nil)
+	if err != nil {
+		return nil, errAuth
+	}
+	increment(nonce)
+	return dst, nil
+}
 
 // Copy copy with initial state.
 func (c *Cipher) Copy() *Cipher {
 	nc := *c
 	nc.enc = nil
 	nc.dec = nil
+	nc.aeadEnc = nil
+	nc.aeadDec = nil
+	nc.encNonce = nil
+	nc.decNonce = nil
 	return &nc
 }
@@ -0,0 +1,143 @@
+package tnt
+
+import (
+	"bytes"
+	"io"
+	"math/rand"
+	"net"
+	"testing"
+)
+
+var testKDF = &KDFConfig{Algorithm: KDFScrypt, Salt: "test", N: 1024}
+
+// recordWrites bytes on the wire of writes through a conn of cipher
+func recordWrites(t *testing.T, cipher *Cipher, writes ...[]byte) []byte {
+	client, server := net.Pipe()
+	recorded := make(chan []byte)
+	go func() {
+		b, _ := io.ReadAll(server)
+		recorded <- b
+	}()
+	c := NewConn(client, cipher.Copy())
+	for _, w := range writes {
+		if _, err := c.Write(w); err != nil {
+			t.Fatal(err)
+		}
+	}
+	client.Close()
+	return <-recorded
+}
+
+// readWire plaintext read from wire through a conn of cipher
+func readWire(cipher *Cipher, wire []byte) ([]byte, error) {
+	client, server := net.Pipe()
+	go func() {
+		client.Write(wire)
+		client.Close()
+	}()
+	defer server.Close()
+	return io.ReadAll(NewConn(server, cipher.Copy()))
+}
+
+func TestAEADChunkFraming(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	big := make([]byte, 2*maxChunkSize+100)
+	rnd.Read(big)
+	writes := [][]byte{[]byte("a"), big, make([]byte, maxChunkSize)}
+
+	for _, method := range []string{"aes-128-gcm", "aes-256-gcm", "chacha20-ietf-poly1305", "xchacha20-ietf-poly1305"} {
+		cipher, err := NewCipherWithKDF(method, "pw", testKDF)
+		if err != nil {
+			t.Fatal(err)
+		}
+		wire := recordWrites(t, cipher, writes...)
+
+		// salt, then every chunk is sealed length and sealed payload
+		overhead := 16
+		want := cipher.info.ivLen
+		var plain []byte
+		for _, w := range writes {
+			for len(w) > 0 {
+				n := len(w)
+				if n > maxChunkSize {
+					n = maxChunkSize
+				}
+				want += lenChunkSize + overhead + n + overhead
+				plain = append(plain, w[:n]...)
+				w = w[n:]
+			}
+		}
+		if len(wire) != want {
+			t.Fatalf("%s: %d bytes on wire, want %d", method, len(wire), want)
+		}
+
+		got, err := readWire(cipher, wire)
+		if err != nil || !bytes.Equal(got, plain) {
+			t.Fatalf("%s: read %d of %d bytes, %v", method, len(got), len(plain), err)
+		}
+
+		// a flipped bit anywhere after the salt fails the chunk, a
+		// truncated chunk is never handed out
+		for _, bad := range [][]byte{
+			flip(wire, cipher.info.ivLen),                       // length
+			flip(wire, cipher.info.ivLen+lenChunkSize+overhead), // payload
+			flip(wire, len(wire)-1),                             // last tag
+			wire[:len(wire)-1],
+		} {
+			got, err = readWire(cipher, bad)
+			if err == nil {
+				t.Fatalf("%s: corrupted wire read", method)
+			}
+			if len(got) > len(plain)-maxChunkSize {
+				t.Fatalf("%s: %d bytes of corrupted chunk handed out", method, len(got))
+			}
+		}
+
+		// another password never authenticates
+		other, _ := NewCipherWithKDF(method, "other", testKDF)
+		if got, err = readWire(other, wire); err == nil || len(got) != 0 {
+			t.Fatalf("%s: read with wrong key, %d bytes, %v", method, len(got), err)
+		}
+	}
+}
+
+func flip(b []byte, i int) []byte {
+	b = append([]byte(nil), b...)
+	b[i] ^= 0x01
+	return b
+}
+
+func TestStreamCipherRoundTrip(t *testing.T) {
+	for _, method := range []string{"aes-128-cfb", "aes-256-cfb", "aes-256-ctr", "rc4-md5"} {
+		for _, kdf := range []*KDFConfig{nil, testKDF} {
+			cipher, err := NewCipherWithKDF(method, "pw", kdf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if cipher.legacy != (kdf == nil) {
+				t.Fatalf("%s: legacy %v with kdf %v", method, cipher.legacy, kdf)
+			}
+			wire := recordWrites(t, cipher, []byte("hello "), []byte("world"))
+			got, err := readWire(cipher, wire)
+			if err != nil || string(got) != "hello world" {
+				t.Fatalf("%s: %q, %v", method, got, err)
+			}
+		}
+	}
+}
+
+func TestNewCipherErrors(t *testing.T) {
+	for _, c := range []struct {
+		method, password string
+		kdf              *KDFConfig
+	}{
+		{"aes-256-gcm", "pw", nil}, // AEAD requires kdf
+		{"aes-256-gcm", "pw", &KDFConfig{Algorithm: KDFScrypt, N: 1024}},
+		{"aes-256-gcm", "", testKDF},
+		{"des", "pw", testKDF},
+	} {
+		if _, err := NewCipherWithKDF(c.method, c.password, c.kdf); err == nil {
+			t.Errorf("%s %q %v: no error", c.method, c.password, c.kdf)
+		}
+	}
+}
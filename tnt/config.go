@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"io/ioutil"
 	"os"
+	"strings"
 	"time"
 )
 
@@ -13,6 +14,14 @@ var (
 	ReadTimeout time.Duration
 )
 
+// Server upstream server of local, method and password default to
+// those of config
+type Server struct {
+	Server   string `json:"server"`
+	Method   string `json:"method"`
+	Password string `json:"password"`
+}
+
 type Config struct {
 	LocalAddr    string `json:"local"`
 	ServerAddr   string `json:"server"`
@@ -21,6 +30,47 @@ type Config struct {
 	Timeout      int    `json:"timeout"`
 	TargetDomain string `json:"target_domain"`
 	TargetPort   uint16 `json:"target_port"`
+
+	// crypto and wire format
+	KDF              *KDFConfig `json:"kdf"`
+	LegacyKey        bool       `json:"legacy_key"`
+	Timestamp        bool       `json:"timestamp"`
+	RequireTimestamp bool       `json:"require_timestamp"`
+	ReplayWindow     int        `json:"replay_window"`
+	Handshake        string     `json:"handshake"`
+	Version          uint8      `json:"traffic_version"`
+	Mux              int        `json:"mux"`
+	UDPTimeout       int        `json:"udp_timeout"`
+
+	// transport
+	Transport string     `json:"transport"`
+	HTTPPath  string     `json:"http_path"`
+	WSPath    string     `json:"ws_path"`
+	WSHost    string     `json:"ws_host"`
+	H2Path    string     `json:"h2_path"`
+	KCP       *KCPConfig `json:"kcp"`
+	TLS       *TLSConfig `json:"tls"`
+
+	// server
+	Users        []*User  `json:"users"`
+	ForwardAllow []string `json:"forward_allow"`
+	ReverseAllow []string `json:"reverse_allow"`
+
+	// local
+	SocksAuth       map[string]string `json:"socks_auth"`
+	SocksAuthFile   string            `json:"socks_auth_file"`
+	HTTPLocalAddr   string            `json:"http_local"`
+	RedirLocalAddr  string            `json:"redir_local"`
+	TProxyLocalAddr string            `json:"tproxy_local"`
+	Forwards        []*Forward        `json:"forwards"`
+	Reverses        []*Reverse        `json:"reverses"`
+	Rules           string            `json:"rules"`
+	GeoIP           string            `json:"geoip"`
+	GeoSite         string            `json:"geosite"`
+	Servers         []*Server         `json:"servers"`
+	Balance         string            `json:"balance"`
+	HealthCheck     string            `json:"health_check"`
+	HealthInterval  int               `json:"health_interval"`
 }
 
 func (c *Config) String() string {
@@ -32,9 +82,72 @@ func (c *Config) String() string {
 	buf.WriteString(fmt.Sprintf("Timeout: %d\n", c.Timeout))
 	buf.WriteString(fmt.Sprintf("TargetDomain: %s\n", c.TargetDomain))
 	buf.WriteString(fmt.Sprintf("TargetPort: %d\n", c.TargetPort))
+	buf.WriteString(fmt.Sprintf("Timestamp: %v\n", c.Timestamp))
+	buf.WriteString(fmt.Sprintf("RequireTimestamp: %t\n", c.RequireTimestamp))
+	buf.WriteString(fmt.Sprintf("ReplayWindow: %d\n", c.ReplayWindow))
+	buf.WriteString(fmt.Sprintf("Handshake: %s\n", c.Handshake))
+	buf.WriteString(fmt.Sprintf("TrafficVersion: %d\n", c.Version))
+	buf.WriteString(fmt.Sprintf("Mux: %d\n", c.Mux))
+	buf.WriteString(fmt.Sprintf("UDPTimeout: %d\n", c.UDPTimeout))
+	buf.WriteString(fmt.Sprintf("SocksAuthFile: %s\n", c.SocksAuthFile))
+	buf.WriteString(fmt.Sprintf("HTTPLocalAddr: %s\n", c.HTTPLocalAddr))
+	buf.WriteString(fmt.Sprintf("RedirLocalAddr: %s\n", c.RedirLocalAddr))
+	buf.WriteString(fmt.Sprintf("TProxyLocalAddr: %s\n", c.TProxyLocalAddr))
+	for _, f := range c.Forwards {
+		buf.WriteString(fmt.Sprintf("Forward: %s -> %s\n", f.Local, f.Target))
+	}
+	for _, a := range c.ForwardAllow {
+		buf.WriteString(fmt.Sprintf("ForwardAllow: %s\n", a))
+	}
+	if c.Rules != "" {
+		buf.WriteString(fmt.Sprintf("Rules: %s\n", c.Rules))
+	}
+	if c.GeoIP != "" {
+		buf.WriteString(fmt.Sprintf("GeoIP: %s\n", c.GeoIP))
+	}
+	if c.GeoSite != "" {
+		buf.WriteString(fmt.Sprintf("GeoSite: %s\n", c.GeoSite))
+	}
+	for _, s := range c.Servers {
+		buf.WriteString(fmt.Sprintf("Server: %s %s\n", s.Server, s.Method))
+	}
+	if c.Balance != "" {
+		buf.WriteString(fmt.Sprintf("Balance: %s\n", c.Balance))
+	}
+	for _, r := range c.Reverses {
+		buf.WriteString(fmt.Sprintf("Reverse: %s <- %s\n", r.Local, r.Remote))
+	}
+	for _, a := range c.ReverseAllow {
+		buf.WriteString(fmt.Sprintf("ReverseAllow: %s\n", a))
+	}
+	for _, u := range c.Users {
+		buf.WriteString(fmt.Sprintf("User: %s\n", u.Name))
+	}
+	if c.Transport != "" {
+		buf.WriteString(fmt.Sprintf("Transport: %s\n", c.Transport))
+	}
+	if c.TLS != nil {
+		buf.WriteString(fmt.Sprintf("TLS: %s\n", c.TLS.ServerName))
+	}
+	if c.KDF != nil {
+		buf.WriteString(fmt.Sprintf("KDF: %s\n", c.KDF))
+	}
+	buf.WriteString(fmt.Sprintf("LegacyKey: %v\n", c.LegacyKey))
 	return buf.String()
 }
 
+// KDFOf kdf deriving the key of method, nil for the legacy key which
+// stream methods keep if legacy_key is set, so that old peers connect
+func (c *Config) KDFOf(method string) *KDFConfig {
+	if c.LegacyKey && !isAEADMethod(method) {
+		return nil
+	}
+	if c.KDF == nil {
+		c.KDF = DefaultKDF()
+	}
+	return c.KDF
+}
+
 func ParseConfig(fpath string) (config *Config, err error) {
 	file, err := os.Open(fpath)
 	if err != nil {
@@ -52,7 +165,68 @@ func ParseConfig(fpath string) (config *Config, err error) {
 		return nil, err
 	}
 
+	// method is only needed when some server inherits it
+	inherit := len(config.Servers) == 0
+	for _, s := range config.Servers {
+		if s.Method == "" {
+			inherit = true
+		}
+	}
+	if inherit && !IsSupportedCipher(config.Method) {
+		return nil, fmt.Errorf("unsupported crypto method: %s, supported: %s",
+			config.Method, strings.Join(ListCiphers(), ", "))
+	}
+	for _, s := range config.Servers {
+		if s.Method == "" {
+			s.Method = config.Method
+		}
+		if s.Password == "" {
+			s.Password = config.Password
+		}
+		if !IsSupportedCipher(s.Method) {
+			return nil, fmt.Errorf("unsupported crypto method of %s: %s", s.Server, s.Method)
+		}
+	}
+
+	methods := []string{config.Method}
+	for _, s := range config.Servers {
+		methods = append(methods, s.Method)
+	}
+	for _, m := range methods {
+		if m != "" && config.KDFOf(m) != nil && config.KDF.Salt == "" {
+			return nil, ErrNoSalt
+		}
+	}
+
 	ReadTimeout = time.Duration(config.Timeout) * time.Second
+	TrafficTimestamp = config.Timestamp
+	if config.UDPTimeout > 0 {
+		UDPTimeout = time.Duration(config.UDPTimeout) * time.Second
+	}
+	switch config.Version {
+	case 0:
+		TrafficVersion = TrafficVersion2
+	case TrafficVersion1, TrafficVersion2:
+		TrafficVersion = config.Version
+	default:
+		return nil, ErrUnknownVersion
+	}
+	if config.Mux > 0 && TrafficVersion != TrafficVersion2 {
+		return nil, fmt.Errorf("mux requires traffic version %d", TrafficVersion2)
+	}
+	if len(config.Reverses) > 0 && TrafficVersion != TrafficVersion2 {
+		return nil, fmt.Errorf("reverses require traffic version %d", TrafficVersion2)
+	}
+	switch config.Handshake {
+	case HandshakeNone, HandshakeX25519:
+		HandshakeMode = config.Handshake
+	default:
+		return nil, fmt.Errorf("unsupported handshake: %s", config.Handshake)
+	}
+	setupTLS(config)
+	if CurrentTransport, err = NewTransport(config); err != nil {
+		return nil, err
+	}
 
 	return
 }
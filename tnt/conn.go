@@ -1,6 +1,7 @@
 package tnt
 
 import (
+	"encoding/binary"
 	"io"
 	"log"
 	"net"
@@ -12,7 +13,12 @@ import (
 type Conn struct {
 	net.Conn
 	*Cipher
-	ID []byte // [16]byte
+	ID       []byte // [16]byte
+	Replay   *ReplayFilter
+	Keyring  *Keyring // server with multiple users
+	User     string   // identified user
+	user     *userEntry
+	leftover []byte // decrypted but unread AEAD payload
 }
 
 var (
@@ -25,22 +31,46 @@ func (c *Conn) Close() error {
 func (c *Conn) Read(b []byte) (n int, err error) {
 	defer HandlePanic()
 
-	if c.dec == nil {
+	if !c.decReady() {
 		// log.Println("no dec, auto gen a dec.")
 		iv := make([]byte, c.info.ivLen)
 		if _, err = io.ReadFull(c.Conn, iv); err != nil {
 			return
 		}
-		if err = c.initDecrpt(iv); err != nil {
+		if c.Replay != nil && c.Replay.Seen(iv) {
+			err = ErrReplay
 			return
 		}
-		if len(c.iv) == 0 {
-			c.iv = iv
+		if c.Keyring != nil && c.user == nil {
+			var size int
+			if size, err = c.identify(iv); err != nil {
+				return
+			}
+			if c.leftover, err = c.readPayload(size); err != nil {
+				return
+			}
+		} else if err = c.initDecrpt(iv); err != nil {
+			return
+		} else if c.IsAEAD() {
+			if c.leftover, err = c.readChunk(); err != nil {
+				return
+			}
+		}
+		// remembered once the first chunk authenticates, so that probes
+		// never fill the filter, stream methods have nothing to wait for
+		if c.Replay != nil && !c.Replay.Check(iv) {
+			err = ErrReplay
+			return
 		}
 	}
+	if c.IsAEAD() {
+		n, err = c.readAEAD(b)
+		return n, c.consume(n, err)
+	}
 
 	buf := make([]byte, len(b))
 	n, err = c.Conn.Read(buf)
+	err = c.consume(n, err)
 	if n > 0 {
 		c.decrypt(b[:n], buf[:n])
 		// log.Printf("[DEC] %d %v -> %v [IV] %v \n", n, buf[:n], b[:n], c.iv)
@@ -50,9 +80,18 @@ func (c *Conn) Read(b []byte) (n int, err error) {
 }
 func (c *Conn) Write(b []byte) (n int, err error) {
 	n, err = c.writeWithCipher(b)
+	err = c.consume(n, err)
 	return
 }
 
+// consume account traffic to the identified user
+func (c *Conn) consume(n int, err error) error {
+	if err == nil && c.user != nil {
+		return c.user.consume(n)
+	}
+	return err
+}
+
 func setReadTimeout(c net.Conn) {
 	if ReadTimeout == 0 {
 		ReadTimeout = 120 * time.Second
@@ -63,6 +102,11 @@ func (c *Conn) SetReadTimeout() {
 	setReadTimeout(c.Conn)
 }
 
+// SetReadTimeout set read deadline of c according to config
+func SetReadTimeout(c net.Conn) {
+	setReadTimeout(c)
+}
+
 func NewConn(c net.Conn, cipher *Cipher) *Conn {
 	return &Conn{
 		Conn:   c,
@@ -71,14 +115,79 @@ func NewConn(c net.Conn, cipher *Cipher) *Conn {
 	}
 }
 
+// readAEAD hand out plaintext chunk by chunk, a chunk fails
+// authentication or truncated will never be handed out.
+func (c *Conn) readAEAD(b []byte) (n int, err error) {
+	if len(c.leftover) == 0 {
+		if c.leftover, err = c.readChunk(); err != nil {
+			return
+		}
+	}
+	n = copy(b, c.leftover)
+	c.leftover = c.leftover[n:]
+	log.Printf("[READ] %d bytes\n", n)
+	return
+}
+
+func (c *Conn) readChunk() (payload []byte, err error) {
+	overhead := c.aeadDec.Overhead()
+	buf := make([]byte, lenChunkSize+overhead)
+	if _, err = io.ReadFull(c.Conn, buf); err != nil {
+		return
+	}
+	size, err := c.open(buf[:0], buf)
+	if err != nil {
+		return
+	}
+	return c.readPayload(int(binary.BigEndian.Uint16(size)) & maxChunkSize)
+}
+
+func (c *Conn) readPayload(payloadLen int) (payload []byte, err error) {
+	buf := make([]byte, payloadLen+c.aeadDec.Overhead())
+	if _, err = io.ReadFull(c.Conn, buf); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return
+	}
+	return c.open(buf[:0], buf)
+}
+
+func (c *Conn) writeAEAD(iv, b []byte) (n int, err error) {
+	overhead := c.aeadEnc.Overhead()
+	chunks := (len(b) + maxChunkSize - 1) / maxChunkSize
+	buf := make([]byte, len(iv), len(iv)+len(b)+chunks*(lenChunkSize+2*overhead))
+	copy(buf, iv)
+
+	size := make([]byte, lenChunkSize)
+	for start := 0; start < len(b); start += maxChunkSize {
+		end := start + maxChunkSize
+		if end > len(b) {
+			end = len(b)
+		}
+		binary.BigEndian.PutUint16(size, uint16(end-start))
+		buf = c.seal(buf, size)
+		buf = c.seal(buf, b[start:end])
+	}
+	if _, err = c.Conn.Write(buf); err != nil {
+		return
+	}
+	n = len(b)
+	log.Printf("[WRITE] %d bytes\n", n)
+	return
+}
+
 func (c *Conn) writeWithCipher(b []byte) (n int, err error) {
 	var iv []byte
-	if c.enc == nil {
+	if !c.encReady() {
 		iv, err = c.initEncrpyt()
 		if err != nil {
 			return
 		}
 	}
+	if c.IsAEAD() {
+		return c.writeAEAD(iv, b)
+	}
 
 	dataLen := len(b) + len(iv)
 	buf := make([]byte, dataLen)
@@ -112,13 +221,28 @@ func Ping(c net.Conn) (result bool) {
 
 // ConnectToServer write rawaddr to server
 func ConnectToServer(network, addr string, tp TrafficType, rawaddr []byte, cipher *Cipher) (c *Conn, err error) {
-	conn, err := net.Dial(network, addr)
+	log.Println("[CONN]", len(rawaddr), rawaddr)
+	return connectToServer(network, addr, NewTraffic(tp, rawaddr), cipher)
+}
+
+func connectToServer(network, addr string, t *Traffic, cipher *Cipher) (c *Conn, err error) {
+	conn, err := Dial(network, addr)
 	if err != nil {
 		return
 	}
+	if HandshakeMode == HandshakeX25519 {
+		setReadTimeout(conn)
+		if cipher, err = ClientHandshake(conn, cipher); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		conn.SetReadDeadline(time.Time{})
+	}
 	c = NewConn(conn, cipher)
-	log.Println("[CONN]", len(rawaddr), rawaddr)
-	traffic := NewTraffic(tp, rawaddr).Bytes()
+	if TrafficTimestamp {
+		t.Timestamp = time.Now().Unix()
+	}
+	traffic := t.Bytes()
 	if _, err = c.writeWithCipher(traffic); err != nil {
 		c.Close()
 		return nil, err
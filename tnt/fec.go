@@ -0,0 +1,222 @@
+package tnt
+
+import (
+	"encoding/binary"
+
+	"github.com/klauspost/reedsolomon"
+)
+
+// Forward error correction of packets, every group of data shards is
+// followed by parity shards of Reed-Solomon code, so that any lost data
+// shards can be recovered from any data+parity - data shards received.
+// | SEQ | FLAG | DATA |
+// |  4  |  2   |  -   |
+// data shard prefixes its packet with 2 bytes length, parity shard is as
+// long as the longest data shard of group.
+const (
+	fecHeaderSize = 6
+	fecSizeLen    = 2
+	fecTypeData   = 0xf1
+	fecTypeParity = 0xf2
+	fecGroupLimit = 64 // groups kept for recovery
+)
+
+type fecEncoder struct {
+	data   int
+	parity int
+	paws   uint32 // seq wraps at a multiple of group size
+	next   uint32
+	shards [][]byte
+	size   int
+	codec  reedsolomon.Encoder
+}
+
+func newFECEncoder(data, parity int) (*fecEncoder, error) {
+	codec, err := reedsolomon.New(data, parity)
+	if err != nil {
+		return nil, err
+	}
+	n := uint32(data + parity)
+	return &fecEncoder{
+		data:   data,
+		parity: parity,
+		paws:   0xffffffff / n * n,
+		codec:  codec,
+	}, nil
+}
+
+func (e *fecEncoder) header(b []byte, flag uint16) {
+	binary.LittleEndian.PutUint32(b, e.next)
+	binary.LittleEndian.PutUint16(b[4:], flag)
+	e.next = (e.next + 1) % e.paws
+}
+
+// encode write p as data shard at once, then parity shards if group is full
+func (e *fecEncoder) encode(p []byte, write func([]byte)) {
+	pkt := make([]byte, fecHeaderSize+fecSizeLen+len(p))
+	e.header(pkt, fecTypeData)
+	binary.LittleEndian.PutUint16(pkt[fecHeaderSize:], uint16(len(p)))
+	copy(pkt[fecHeaderSize+fecSizeLen:], p)
+	write(pkt)
+
+	shard := pkt[fecHeaderSize:]
+	e.shards = append(e.shards, shard)
+	if len(shard) > e.size {
+		e.size = len(shard)
+	}
+	if len(e.shards) < e.data {
+		return
+	}
+
+	shards := make([][]byte, e.data+e.parity)
+	for i, s := range e.shards {
+		shards[i] = make([]byte, e.size)
+		copy(shards[i], s)
+	}
+	for i := e.data; i < len(shards); i++ {
+		shards[i] = make([]byte, e.size)
+	}
+	if err := e.codec.Encode(shards); err == nil {
+		for _, s := range shards[e.data:] {
+			pkt := make([]byte, fecHeaderSize+len(s))
+			e.header(pkt, fecTypeParity)
+			copy(pkt[fecHeaderSize:], s)
+			write(pkt)
+		}
+	}
+	e.shards = e.shards[:0]
+	e.size = 0
+}
+
+type fecGroup struct {
+	shards [][]byte
+	count  int
+	done   bool
+}
+
+type fecDecoder struct {
+	data   int
+	parity int
+	ring   uint32 // count of group ids before seq wraps
+	newest uint32
+	groups map[uint32]*fecGroup
+	codec  reedsolomon.Encoder
+}
+
+func newFECDecoder(data, parity int) (*fecDecoder, error) {
+	codec, err := reedsolomon.New(data, parity)
+	if err != nil {
+		return nil, err
+	}
+	return &fecDecoder{
+		data:   data,
+		parity: parity,
+		ring:   0xffffffff / uint32(data+parity),
+		groups: make(map[uint32]*fecGroup),
+		codec:  codec,
+	}, nil
+}
+
+// decode deliver the packet carried by pkt, and those recovered with it
+func (d *fecDecoder) decode(pkt []byte, deliver func(p []byte, recovered bool)) {
+	if len(pkt) <= fecHeaderSize {
+		return
+	}
+	seq := binary.LittleEndian.Uint32(pkt)
+	flag := binary.LittleEndian.Uint16(pkt[4:])
+	shard := pkt[fecHeaderSize:]
+	switch flag {
+	case fecTypeData:
+		p, ok := fecPayload(shard)
+		if !ok {
+			return
+		}
+		deliver(p, false)
+	case fecTypeParity:
+	default:
+		return
+	}
+
+	n := uint32(d.data + d.parity)
+	id := seq / n
+	g := d.groups[id]
+	if g == nil {
+		if d.since(id) < -fecGroupLimit {
+			return
+		}
+		if d.since(id) > 0 {
+			d.newest = id
+		}
+		for k := range d.groups {
+			if d.since(k) < -fecGroupLimit {
+				delete(d.groups, k)
+			}
+		}
+		g = &fecGroup{shards: make([][]byte, n)}
+		d.groups[id] = g
+	}
+	i := seq % n
+	if g.done || g.shards[i] != nil {
+		return
+	}
+	g.shards[i] = append([]byte(nil), shard...)
+	g.count++
+	if g.count < d.data {
+		return
+	}
+
+	g.done = true
+	shards := g.shards
+	g.shards = nil
+	var missing []int
+	size := 0
+	for i, s := range shards {
+		if s == nil {
+			if i < d.data {
+				missing = append(missing, i)
+			}
+		} else if i >= d.data {
+			size = len(s)
+		}
+	}
+	if len(missing) == 0 || size == 0 {
+		return
+	}
+	for i, s := range shards {
+		if s == nil {
+			continue
+		}
+		if len(s) > size {
+			return
+		}
+		shards[i] = append(s, make([]byte, size-len(s))...)
+	}
+	if err := d.codec.ReconstructData(shards); err != nil {
+		return
+	}
+	for _, i := range missing {
+		if p, ok := fecPayload(shards[i]); ok {
+			deliver(p, true)
+		}
+	}
+}
+
+// since distance of group id from the newest
+func (d *fecDecoder) since(id uint32) int32 {
+	n := (id + d.ring - d.newest) % d.ring
+	if n > d.ring/2 {
+		return int32(n) - int32(d.ring)
+	}
+	return int32(n)
+}
+
+func fecPayload(shard []byte) ([]byte, bool) {
+	if len(shard) < fecSizeLen {
+		return nil, false
+	}
+	n := int(binary.LittleEndian.Uint16(shard))
+	if n > len(shard)-fecSizeLen {
+		return nil, false
+	}
+	return shard[fecSizeLen : fecSizeLen+n], true
+}
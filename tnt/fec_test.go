@@ -0,0 +1,109 @@
+package tnt
+
+import (
+	"bytes"
+	"testing"
+)
+
+// fecGroupOf encode packets of group 0, return them as sent
+func fecGroupOf(t *testing.T, enc *fecEncoder, payloads [][]byte) [][]byte {
+	var pkts [][]byte
+	for _, p := range payloads {
+		enc.encode(p, func(b []byte) { pkts = append(pkts, append([]byte(nil), b...)) })
+	}
+	if len(pkts) != enc.data+enc.parity {
+		t.Fatalf("%d packets of group", len(pkts))
+	}
+	return pkts
+}
+
+func TestFECRecoverData(t *testing.T) {
+	payloads := [][]byte{
+		[]byte("a"),
+		bytes.Repeat([]byte{1}, 300),
+		nil,
+		bytes.Repeat([]byte{2}, 1200),
+	}
+	// every pair of data shards lost
+	for i := 0; i < 4; i++ {
+		for j := i + 1; j < 4; j++ {
+			enc, _ := newFECEncoder(4, 2)
+			dec, _ := newFECDecoder(4, 2)
+			pkts := fecGroupOf(t, enc, payloads)
+
+			got := make(map[int][]byte)
+			for k, pkt := range pkts {
+				if k == i || k == j {
+					continue
+				}
+				dec.decode(pkt, func(p []byte, recovered bool) {
+					for n, want := range payloads {
+						if bytes.Equal(p, want) && (n == i || n == j) == recovered {
+							got[n] = append([]byte(nil), p...)
+							return
+						}
+					}
+					t.Fatalf("lost %d %d: unexpected %d bytes, recovered %v", i, j, len(p), recovered)
+				})
+			}
+			if len(got) != 4 {
+				t.Fatalf("lost %d %d: got %d of 4", i, j, len(got))
+			}
+		}
+	}
+}
+
+func TestFECTooManyLost(t *testing.T) {
+	enc, _ := newFECEncoder(4, 2)
+	dec, _ := newFECDecoder(4, 2)
+	pkts := fecGroupOf(t, enc, [][]byte{[]byte("a"), []byte("b"), []byte("c"), []byte("d")})
+
+	n := 0
+	for _, k := range []int{0, 4, 5} {
+		dec.decode(pkts[k], func(p []byte, recovered bool) {
+			if recovered {
+				t.Fatal("recovered from too few shards")
+			}
+			n++
+		})
+	}
+	if n != 1 {
+		t.Fatalf("delivered %d", n)
+	}
+}
+
+func TestFECDuplicateAndLate(t *testing.T) {
+	enc, _ := newFECEncoder(2, 1)
+	dec, _ := newFECDecoder(2, 1)
+	pkts := fecGroupOf(t, enc, [][]byte{[]byte("first"), []byte("second")})
+
+	var got []string
+	deliver := func(p []byte, recovered bool) { got = append(got, string(p)) }
+	dec.decode(pkts[0], deliver)
+	dec.decode(pkts[2], deliver) // parity recovers "second"
+	dec.decode(pkts[2], deliver) // duplicated parity changes nothing
+	dec.decode(pkts[1], deliver) // late data is still delivered, ARQ drops it
+	want := []string{"first", "second", "second"}
+	if len(got) != len(want) {
+		t.Fatalf("got %q", got)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("got %q", got)
+		}
+	}
+}
+
+func TestFECMalformed(t *testing.T) {
+	dec, _ := newFECDecoder(4, 2)
+	for _, pkt := range [][]byte{
+		nil,
+		{0, 0, 0, 0, fecTypeData, 0},
+		{0, 0, 0, 0, fecTypeData, 0, 0xff, 0xff, 1},
+		{0, 0, 0, 0, 0x33, 0, 1, 0, 1},
+	} {
+		dec.decode(pkt, func(p []byte, recovered bool) {
+			t.Fatalf("delivered %v from %v", p, pkt)
+		})
+	}
+}
@@ -0,0 +1,305 @@
+package tnt
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"regexp"
+	"strings"
+
+	"github.com/oschwald/maxminddb-golang"
+)
+
+// offline databases of routing rules, either MaxMind MMDB or
+// v2ray-style geoip.dat for countries, and geosite.dat for site lists.
+var (
+	geoIPReader *maxminddb.Reader
+	geoIPList   map[string][]byte // country code to encoded GeoIP message
+	geoSiteList map[string][]byte // list name to encoded GeoSite message
+
+	ErrNoGeoIP   = errors.New("geoip database not loaded")
+	ErrNoGeoSite = errors.New("geosite database not loaded")
+	errProtobuf  = errors.New("malformed protobuf")
+)
+
+// LoadGeoIP load MMDB, or geoip.dat if the file ends with .dat
+func LoadGeoIP(path string) (err error) {
+	if strings.HasSuffix(path, ".dat") {
+		geoIPList, err = loadDat(path)
+		return
+	}
+	geoIPReader, err = maxminddb.Open(path)
+	return
+}
+
+// LoadGeoSite load geosite.dat
+func LoadGeoSite(path string) (err error) {
+	geoSiteList, err = loadDat(path)
+	return
+}
+
+// loadDat index entries of GeoIPList or GeoSiteList by code, both are
+// message { repeated entry = 1; } whose entries begin with string code = 1.
+func loadDat(path string) (map[string][]byte, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	list := make(map[string][]byte)
+	err = eachField(data, func(num int, v []byte) error {
+		if num != 1 {
+			return nil
+		}
+		return eachField(v, func(num int, code []byte) error {
+			if num == 1 {
+				list[strings.ToUpper(string(code))] = v
+				return errStop
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return list, nil
+}
+
+var errStop = errors.New("stop")
+
+// eachField walk fields of protobuf message, fn is given the bytes of
+// length-delimited fields, and the varint of varint fields.
+func eachField(b []byte, fn func(num int, v []byte) error) error {
+	for len(b) > 0 {
+		key, n := binary.Uvarint(b)
+		if n <= 0 {
+			return errProtobuf
+		}
+		b = b[n:]
+		num, wire := int(key>>3), key&7
+
+		var v []byte
+		switch wire {
+		case 0: // varint
+			if _, n = binary.Uvarint(b); n <= 0 {
+				return errProtobuf
+			}
+			v, b = b[:n], b[n:]
+		case 1: // 64-bit
+			if len(b) < 8 {
+				return errProtobuf
+			}
+			v, b = b[:8], b[8:]
+		case 2: // length-delimited
+			l, n := binary.Uvarint(b)
+			if n <= 0 || uint64(len(b)-n) < l {
+				return errProtobuf
+			}
+			v, b = b[n:n+int(l)], b[n+int(l):]
+		case 5: // 32-bit
+			if len(b) < 4 {
+				return errProtobuf
+			}
+			v, b = b[:4], b[4:]
+		default:
+			return errProtobuf
+		}
+		if err := fn(num, v); err == errStop {
+			return nil
+		} else if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func varint(v []byte) uint64 {
+	x, _ := binary.Uvarint(v)
+	return x
+}
+
+// geoIPMatcher IPs of country code
+func geoIPMatcher(code string) (func(ip net.IP) bool, error) {
+	code = strings.ToUpper(code)
+	if geoIPReader != nil {
+		reader := geoIPReader
+		return func(ip net.IP) bool {
+			var record struct {
+				Country struct {
+					ISOCode string `maxminddb:"iso_code"`
+				} `maxminddb:"country"`
+			}
+			if err := reader.Lookup(ip, &record); err != nil {
+				return false
+			}
+			return record.Country.ISOCode == code
+		}, nil
+	}
+	if geoIPList == nil {
+		return nil, ErrNoGeoIP
+	}
+	entry, ok := geoIPList[code]
+	if !ok {
+		return nil, fmt.Errorf("geoip: no such code %s", code)
+	}
+
+	// message GeoIP { string country_code = 1; repeated CIDR cidr = 2;
+	//                 bool reverse_match = 3; }
+	// message CIDR { bytes ip = 1; uint32 prefix = 2; }
+	var nets []*net.IPNet
+	var reverse bool
+	err := eachField(entry, func(num int, v []byte) error {
+		switch num {
+		case 2:
+			var ip []byte
+			var prefix int
+			if err := eachField(v, func(num int, v []byte) error {
+				switch num {
+				case 1:
+					ip = v
+				case 2:
+					prefix = int(varint(v))
+				}
+				return nil
+			}); err != nil {
+				return err
+			}
+			if len(ip) != net.IPv4len && len(ip) != net.IPv6len {
+				return errProtobuf
+			}
+			mask := net.CIDRMask(prefix, len(ip)*8)
+			if mask == nil {
+				return errProtobuf
+			}
+			nets = append(nets, &net.IPNet{IP: net.IP(ip).Mask(mask), Mask: mask})
+		case 3:
+			reverse = varint(v) != 0
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return func(ip net.IP) bool {
+		if ip4 := ip.To4(); ip4 != nil {
+			ip = ip4
+		}
+		for _, n := range nets {
+			if n.Contains(ip) {
+				return !reverse
+			}
+		}
+		return reverse
+	}, nil
+}
+
+// types of domain in geosite.dat
+const (
+	siteKeyword = 0
+	siteRegex   = 1
+	siteSuffix  = 2
+	siteFull    = 3
+)
+
+// geoSiteMatcher hosts of list name, "name@attr" keeps only the domains
+// with attribute attr.
+func geoSiteMatcher(name string) (func(host string) bool, error) {
+	if geoSiteList == nil {
+		return nil, ErrNoGeoSite
+	}
+	var attr string
+	if i := strings.IndexByte(name, '@'); i >= 0 {
+		name, attr = name[:i], name[i+1:]
+	}
+	entry, ok := geoSiteList[strings.ToUpper(name)]
+	if !ok {
+		return nil, fmt.Errorf("geosite: no such list %s", name)
+	}
+
+	// message GeoSite { string country_code = 1; repeated Domain domain = 2; }
+	// message Domain { Type type = 1; string value = 2;
+	//                  repeated Attribute attribute = 3; }
+	// message Attribute { string key = 1; ... }
+	full := make(map[string]bool)
+	suffix := make(map[string]bool)
+	var keywords []string
+	var regexes []*regexp.Regexp
+	err := eachField(entry, func(num int, v []byte) error {
+		if num != 2 {
+			return nil
+		}
+		var tp uint64
+		var value string
+		hasAttr := attr == ""
+		if err := eachField(v, func(num int, v []byte) error {
+			switch num {
+			case 1:
+				tp = varint(v)
+			case 2:
+				value = string(v)
+			case 3:
+				return eachField(v, func(num int, key []byte) error {
+					if num == 1 && string(key) == attr {
+						hasAttr = true
+					}
+					return nil
+				})
+			}
+			return nil
+		}); err != nil {
+			return err
+		}
+		if !hasAttr {
+			return nil
+		}
+		if tp != siteRegex {
+			// lowering would change classes like \W or \P{Han} of regex
+			value = strings.ToLower(value)
+		}
+		switch tp {
+		case siteKeyword:
+			keywords = append(keywords, value)
+		case siteRegex:
+			re, err := regexp.Compile("(?i)" + value)
+			if err != nil {
+				return err
+			}
+			regexes = append(regexes, re)
+		case siteSuffix:
+			suffix[value] = true
+		case siteFull:
+			full[value] = true
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return func(host string) bool {
+		if full[host] {
+			return true
+		}
+		for h := host; ; {
+			if suffix[h] {
+				return true
+			}
+			i := strings.IndexByte(h, '.')
+			if i < 0 {
+				break
+			}
+			h = h[i+1:]
+		}
+		for _, k := range keywords {
+			if strings.Contains(host, k) {
+				return true
+			}
+		}
+		for _, re := range regexes {
+			if re.MatchString(host) {
+				return true
+			}
+		}
+		return false
+	}, nil
+}
@@ -0,0 +1,156 @@
+package tnt
+
+import (
+	"encoding/binary"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func cat(parts ...[]byte) []byte {
+	var b []byte
+	for _, p := range parts {
+		b = append(b, p...)
+	}
+	return b
+}
+
+// pbBytes length-delimited field of protobuf
+func pbBytes(num int, v ...[]byte) []byte {
+	body := cat(v...)
+	b := binary.AppendUvarint(nil, uint64(num)<<3|2)
+	b = binary.AppendUvarint(b, uint64(len(body)))
+	return append(b, body...)
+}
+
+// pbVarint varint field of protobuf
+func pbVarint(num int, x uint64) []byte {
+	return binary.AppendUvarint(binary.AppendUvarint(nil, uint64(num)<<3), x)
+}
+
+func writeDat(t *testing.T, entries ...[]byte) string {
+	var list []byte
+	for _, e := range entries {
+		list = append(list, pbBytes(1, e)...)
+	}
+	path := filepath.Join(t.TempDir(), "test.dat")
+	if err := os.WriteFile(path, list, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func siteDomain(tp uint64, value string, attrs ...string) []byte {
+	d := cat(pbVarint(1, tp), pbBytes(2, []byte(value)))
+	for _, a := range attrs {
+		d = append(d, pbBytes(3, pbBytes(1, []byte(a)))...)
+	}
+	return pbBytes(2, d)
+}
+
+func TestGeoSite(t *testing.T) {
+	defer func() { geoSiteList = nil }()
+	path := writeDat(t,
+		cat(pbBytes(1, []byte("other")), siteDomain(siteFull, "other.com")),
+		cat(pbBytes(1, []byte("test")),
+			siteDomain(siteKeyword, "ADS"),
+			siteDomain(siteRegex, `^cdn\d+\.example\.org$`),
+			siteDomain(siteSuffix, "Example.com", "cn"),
+			siteDomain(siteFull, "exact.net", "cn", "ads")),
+	)
+	if err := LoadGeoSite(path); err != nil {
+		t.Fatal(err)
+	}
+	test, err := geoSiteMatcher("TEST")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cn, err := geoSiteMatcher("test@cn")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []struct {
+		host     string
+		test, cn bool
+	}{
+		{"myads.net", true, false},
+		{"cdn1.example.org", true, false},
+		{"cdn.example.org", false, false},
+		{"example.com", true, true},
+		{"a.b.example.com", true, true},
+		{"notexample.com", false, false},
+		{"exact.net", true, true},
+		{"a.exact.net", false, false},
+		{"other.com", false, false},
+	} {
+		if test(c.host) != c.test || cn(c.host) != c.cn {
+			t.Errorf("%s: test %v, cn %v", c.host, test(c.host), cn(c.host))
+		}
+	}
+	if _, err = geoSiteMatcher("missing"); err == nil {
+		t.Error("missing list matched")
+	}
+}
+
+func TestGeoIP(t *testing.T) {
+	defer func() { geoIPList = nil }()
+	cidr := func(ip net.IP, prefix uint64) []byte {
+		return pbBytes(2, pbBytes(1, ip), pbVarint(2, prefix))
+	}
+	path := writeDat(t,
+		cat(pbBytes(1, []byte("cn")), cidr(net.IPv4(1, 0, 1, 0).To4(), 24), cidr(net.ParseIP("2001:db8::"), 32)),
+		cat(pbBytes(1, []byte("not")), cidr(net.IPv4(10, 0, 0, 0).To4(), 8), pbVarint(3, 1)),
+	)
+	if err := LoadGeoIP(path); err != nil {
+		t.Fatal(err)
+	}
+	cn, err := geoIPMatcher("CN")
+	if err != nil {
+		t.Fatal(err)
+	}
+	not, err := geoIPMatcher("not")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []struct {
+		ip      string
+		cn, not bool
+	}{
+		{"1.0.1.200", true, true},
+		{"1.0.2.1", false, true},
+		{"::ffff:1.0.1.1", true, true},
+		{"2001:db8::1", true, true},
+		{"2001:db9::1", false, true},
+		{"10.1.1.1", false, false},
+	} {
+		ip := net.ParseIP(c.ip)
+		if cn(ip) != c.cn || not(ip) != c.not {
+			t.Errorf("%s: cn %v, not %v", c.ip, cn(ip), not(ip))
+		}
+	}
+}
+
+func TestEachFieldMalformed(t *testing.T) {
+	for _, b := range [][]byte{
+		{0x80},            // truncated key
+		{0x08},            // missing varint
+		{0x08, 0x80},      // truncated varint
+		{0x12, 0x05, 'a'}, // length beyond message
+		{0x09, 1, 2, 3},   // short 64-bit
+		{0x0d, 1, 2},      // short 32-bit
+		{0x0b},            // group wire type
+		{0x12, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x01}, // huge length
+	} {
+		if err := eachField(b, func(int, []byte) error { return nil }); err != errProtobuf {
+			t.Errorf("%x: %v", b, err)
+		}
+	}
+
+	// malformed entries fail loading
+	path := filepath.Join(t.TempDir(), "bad.dat")
+	os.WriteFile(path, []byte{0x0a, 0x02, 0x0a, 0x05}, 0644)
+	if _, err := loadDat(path); err == nil {
+		t.Error("malformed dat loaded")
+	}
+}
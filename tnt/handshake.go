@@ -0,0 +1,138 @@
+package tnt
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"io"
+	"net"
+
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/hkdf"
+)
+
+const (
+	HandshakeNone   = ""
+	HandshakeX25519 = "x25519"
+
+	lenPublicKey = curve25519.PointSize
+	lenHSMac     = 16
+	lenHSMsg     = lenPublicKey + lenHSMac
+
+	hsClientLabel = "tnt-hs-client"
+	hsServerLabel = "tnt-hs-server"
+	hsSessionInfo = "tnt-session"
+)
+
+var (
+	// HandshakeMode how client establish the session key
+	HandshakeMode string
+
+	ErrHandshake = errors.New("handshake authentication failed")
+)
+
+// Handshake exchange ephemeral X25519 keys before any traffic.
+// Both messages are authenticated by the master key derived from the
+// pre-shared password, and the session key is derived from the shared
+// secret, so a leaked password cannot decrypt recorded sessions.
+//
+// client -> server: ephemeral_c | HMAC(master, label_c | ephemeral_c)
+// server -> client: ephemeral_s | HMAC(master, label_s | ephemeral_c | ephemeral_s)
+// session key = HKDF(shared secret, master, info | ephemeral_c | ephemeral_s)
+
+// ClientHandshake return cipher driven by the session key
+func ClientHandshake(conn net.Conn, c *Cipher) (*Cipher, error) {
+	priv, pub, err := ephemeralKey()
+	if err != nil {
+		return nil, err
+	}
+	msg := append(pub, hsMac(c.key, hsClientLabel, pub)...)
+	if _, err = conn.Write(msg); err != nil {
+		return nil, err
+	}
+
+	resp := make([]byte, lenHSMsg)
+	if _, err = io.ReadFull(conn, resp); err != nil {
+		return nil, err
+	}
+	peer := resp[:lenPublicKey]
+	if !hmac.Equal(resp[lenPublicKey:], hsMac(c.key, hsServerLabel, pub, peer)) {
+		return nil, ErrHandshake
+	}
+	return c.session(priv, peer, pub, peer)
+}
+
+// ServerHandshake return cipher driven by the session key,
+// ephemeral key of client is checked against replay filter if given.
+func ServerHandshake(conn net.Conn, c *Cipher, replay *ReplayFilter) (*Cipher, error) {
+	msg, err := readHello(conn)
+	if err != nil {
+		return nil, err
+	}
+	if !hmac.Equal(msg[lenPublicKey:], hsMac(c.key, hsClientLabel, msg[:lenPublicKey])) {
+		return nil, ErrHandshake
+	}
+	return serverRespond(conn, c, msg, replay)
+}
+
+func readHello(conn net.Conn) ([]byte, error) {
+	msg := make([]byte, lenHSMsg)
+	if _, err := io.ReadFull(conn, msg); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+// serverRespond answer an authenticated hello
+func serverRespond(conn net.Conn, c *Cipher, msg []byte, replay *ReplayFilter) (*Cipher, error) {
+	peer := msg[:lenPublicKey]
+	if replay != nil && !replay.Check(peer) {
+		return nil, ErrReplay
+	}
+
+	priv, pub, err := ephemeralKey()
+	if err != nil {
+		return nil, err
+	}
+	resp := append(pub, hsMac(c.key, hsServerLabel, peer, pub)...)
+	if _, err = conn.Write(resp); err != nil {
+		return nil, err
+	}
+	return c.session(priv, peer, peer, pub)
+}
+
+func ephemeralKey() (priv, pub []byte, err error) {
+	priv = make([]byte, curve25519.ScalarSize)
+	if _, err = io.ReadFull(rand.Reader, priv); err != nil {
+		return
+	}
+	pub, err = curve25519.X25519(priv, curve25519.Basepoint)
+	return
+}
+
+func hsMac(key []byte, label string, parts ...[]byte) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(label))
+	for _, p := range parts {
+		h.Write(p)
+	}
+	return h.Sum(nil)[:lenHSMac]
+}
+
+// session copy the cipher with key derived from ephemeral keys
+func (c *Cipher) session(priv, peer, clientPub, serverPub []byte) (*Cipher, error) {
+	shared, err := curve25519.X25519(priv, peer)
+	if err != nil {
+		return nil, err
+	}
+	info := append([]byte(hsSessionInfo), clientPub...)
+	info = append(info, serverPub...)
+
+	nc := c.Copy()
+	nc.key = make([]byte, len(c.key))
+	if _, err = io.ReadFull(hkdf.New(sha256.New, shared, c.key, info), nc.key); err != nil {
+		return nil, err
+	}
+	return nc, nil
+}
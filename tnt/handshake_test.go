@@ -0,0 +1,108 @@
+package tnt
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// handshake run both ends over a pipe, return their session ciphers
+func handshake(client, server *Cipher, replay *ReplayFilter) (cs, ss *Cipher, cerr, serr error) {
+	a, b := net.Pipe()
+	defer a.Close()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		defer b.Close()
+		ss, serr = ServerHandshake(b, server, replay)
+	}()
+	cs, cerr = ClientHandshake(a, client)
+	a.Close()
+	<-done
+	return
+}
+
+func TestHandshake(t *testing.T) {
+	cipher, err := NewCipherWithKDF("aes-256-gcm", "pw", testKDF)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, _ := NewCipherWithKDF("aes-256-gcm", "other", testKDF)
+
+	cs, ss, cerr, serr := handshake(cipher, cipher, nil)
+	if cerr != nil || serr != nil {
+		t.Fatal(cerr, serr)
+	}
+	if !bytes.Equal(cs.key, ss.key) || bytes.Equal(cs.key, cipher.key) {
+		t.Fatal("session keys differ or equal to master")
+	}
+	got, err := readWire(ss, recordWrites(t, cs, []byte("hello")))
+	if err != nil || string(got) != "hello" {
+		t.Fatalf("%q, %v", got, err)
+	}
+	// recorded traffic is useless with the master key alone
+	if _, err = readWire(cipher, recordWrites(t, cs, []byte("hello"))); err == nil {
+		t.Fatal("session traffic read by master key")
+	}
+
+	// every session takes a new key
+	cs2, _, _, _ := handshake(cipher, cipher, nil)
+	if bytes.Equal(cs.key, cs2.key) {
+		t.Fatal("session key reused")
+	}
+
+	// either end with another password
+	if _, _, _, serr = handshake(other, cipher, nil); serr != ErrHandshake {
+		t.Fatalf("server: %v", serr)
+	}
+	a, b := net.Pipe()
+	go func() {
+		// answer by a server of another password
+		if msg, err := readHello(b); err == nil {
+			serverRespond(b, other, msg, nil)
+		}
+	}()
+	if _, err = ClientHandshake(a, cipher); err != ErrHandshake {
+		t.Fatalf("client: %v", err)
+	}
+	a.Close()
+	b.Close()
+}
+
+func TestHandshakeReplay(t *testing.T) {
+	cipher, err := NewCipherWithKDF("aes-256-gcm", "pw", testKDF)
+	if err != nil {
+		t.Fatal(err)
+	}
+	replay := NewReplayFilter(time.Minute)
+
+	// record hello of client
+	a, b := net.Pipe()
+	go ClientHandshake(a, cipher)
+	hello := make([]byte, lenHSMsg)
+	if _, err = io.ReadFull(b, hello); err != nil {
+		t.Fatal(err)
+	}
+	a.Close()
+	b.Close()
+
+	serve := func() error {
+		a, b := net.Pipe()
+		defer a.Close()
+		go func() {
+			a.Write(hello)
+			io.Copy(io.Discard, a)
+		}()
+		_, err := ServerHandshake(b, cipher, replay)
+		b.Close()
+		return err
+	}
+	if err = serve(); err != nil {
+		t.Fatal(err)
+	}
+	if err = serve(); err != ErrReplay {
+		t.Fatalf("replayed hello: %v", err)
+	}
+}
@@ -0,0 +1,99 @@
+package tnt
+
+import (
+	"errors"
+	"fmt"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/scrypt"
+)
+
+const (
+	KDFArgon2id = "argon2id"
+	KDFScrypt   = "scrypt"
+)
+
+// ErrNoSalt salt must be chosen per deployment, a shared one would let
+// passwords be cracked with tables computed once for all
+var ErrNoSalt = errors.New("kdf: salt is required, the same random string on both ends")
+
+// KDFConfig parameters of the password KDF, both ends must be the same
+type KDFConfig struct {
+	Algorithm string `json:"algorithm"`
+	Salt      string `json:"salt"`
+	// argon2id
+	Time    uint32 `json:"time"`
+	Memory  uint32 `json:"memory"` // KiB
+	Threads uint8  `json:"threads"`
+	// scrypt
+	N int `json:"n"`
+	R int `json:"r"`
+	P int `json:"p"`
+}
+
+// DefaultKDF argon2id with moderate cost, salt left to be chosen
+func DefaultKDF() *KDFConfig {
+	return &KDFConfig{
+		Algorithm: KDFArgon2id,
+		Time:      3,
+		Memory:    64 * 1024,
+		Threads:   4,
+	}
+}
+
+func (k *KDFConfig) String() string {
+	switch k.Algorithm {
+	case KDFScrypt:
+		return fmt.Sprintf("%s(n=%d, r=%d, p=%d)", k.Algorithm, k.N, k.R, k.P)
+	default:
+		return fmt.Sprintf("%s(t=%d, m=%d, p=%d)", k.Algorithm, k.Time, k.Memory, k.Threads)
+	}
+}
+
+// fill zero fields with default values
+func (k *KDFConfig) normalize() {
+	if k.Algorithm == "" {
+		k.Algorithm = KDFArgon2id
+	}
+	switch k.Algorithm {
+	case KDFArgon2id:
+		d := DefaultKDF()
+		if k.Time == 0 {
+			k.Time = d.Time
+		}
+		if k.Memory == 0 {
+			k.Memory = d.Memory
+		}
+		if k.Threads == 0 {
+			k.Threads = d.Threads
+		}
+	case KDFScrypt:
+		if k.N == 0 {
+			k.N = 1 << 15
+		}
+		if k.R == 0 {
+			k.R = 8
+		}
+		if k.P == 0 {
+			k.P = 1
+		}
+	}
+}
+
+// deriveKey stretch password into master key
+func deriveKey(password string, keyLen int, kdf *KDFConfig) ([]byte, error) {
+	if kdf == nil || kdf.Salt == "" {
+		return nil, ErrNoSalt
+	}
+	k := *kdf
+	k.normalize()
+
+	switch k.Algorithm {
+	case KDFArgon2id:
+		return argon2.IDKey([]byte(password), []byte(k.Salt), k.Time, k.Memory, k.Threads, uint32(keyLen)), nil
+	case KDFScrypt:
+		return scrypt.Key([]byte(password), []byte(k.Salt), k.N, k.R, k.P, keyLen)
+	default:
+		return nil, fmt.Errorf("unsupported kdf: %s", k.Algorithm)
+	}
+}
@@ -0,0 +1,56 @@
+package tnt
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestDeriveKey(t *testing.T) {
+	k := &KDFConfig{Algorithm: KDFScrypt, Salt: "a", N: 1024}
+	a1, err := deriveKey("pw", 32, k)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *k != (KDFConfig{Algorithm: KDFScrypt, Salt: "a", N: 1024}) {
+		t.Fatalf("config changed to %+v", k)
+	}
+	a2, _ := deriveKey("pw", 32, k)
+	b, _ := deriveKey("pw", 32, &KDFConfig{Algorithm: KDFScrypt, Salt: "b", N: 1024})
+	if len(a1) != 32 || !bytes.Equal(a1, a2) || bytes.Equal(a1, b) {
+		t.Fatal("key not determined by password and salt")
+	}
+
+	for _, k := range []*KDFConfig{nil, {Algorithm: KDFScrypt, N: 1024}, DefaultKDF()} {
+		if _, err = deriveKey("pw", 32, k); err != ErrNoSalt {
+			t.Errorf("%v: %v", k, err)
+		}
+	}
+	if _, err = deriveKey("pw", 32, &KDFConfig{Algorithm: "md5", Salt: "a"}); err == nil {
+		t.Error("unknown kdf accepted")
+	}
+}
+
+func TestConfigSalt(t *testing.T) {
+	dir := t.TempDir()
+	for _, c := range []struct {
+		json string
+		ok   bool
+	}{
+		{`{"method":"aes-256-gcm","password":"pw"}`, false},
+		{`{"method":"aes-256-cfb","password":"pw"}`, false},
+		{`{"method":"aes-256-cfb","password":"pw","legacy_key":true}`, true},
+		{`{"method":"aes-256-gcm","password":"pw","legacy_key":true}`, false},
+		{`{"method":"aes-256-gcm","password":"pw","kdf":{"salt":"s"}}`, true},
+		{`{"servers":[{"server":"a:1","method":"aes-256-cfb"},{"server":"b:1","method":"aes-256-gcm"}],"legacy_key":true}`, false},
+	} {
+		path := filepath.Join(dir, "config.json")
+		if err := os.WriteFile(path, []byte(c.json), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := ParseConfig(path); (err == nil) != c.ok {
+			t.Errorf("%s: %v", c.json, err)
+		}
+	}
+}
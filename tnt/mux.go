@@ -0,0 +1,560 @@
+package tnt
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Mux carry many logical streams over one tunnel connection.
+//
+// A mux connection begins with a TrafficMux, after that every traffic
+// is a frame whose payload is:
+// | STREAM ID | BODY     |
+// |     4     | Variable |
+//
+// TrafficOpen:         BODY is the rawaddr of target
+// TrafficData:         BODY is data
+// TrafficClose:        no BODY
+// TrafficWindowUpdate: BODY is the 4 bytes increment of window
+//
+// Every stream may have at most initialWindow bytes in flight, so that
+// one stream cannot starve the others.
+//
+// Both ends send a window update of stream 0, which never exists, every
+// muxKeepAlive as keepalive, and close the session once nothing arrived
+// for muxIdleTimeout. Peers predating it ignore such updates.
+const (
+	lenStreamID   = 4
+	maxFrameData  = 16 * 1024
+	initialWindow = 256 * 1024
+)
+
+var (
+	muxKeepAlive   = 10 * time.Second
+	muxIdleTimeout = 3 * muxKeepAlive
+)
+
+var (
+	ErrSessionClosed = errors.New("session closed")
+	ErrStreamClosed  = errors.New("stream closed")
+	ErrBadFrame      = errors.New("malformed mux frame")
+	errTimeout       = &timeoutError{}
+)
+
+type timeoutError struct{}
+
+func (e *timeoutError) Error() string   { return "i/o timeout" }
+func (e *timeoutError) Timeout() bool   { return true }
+func (e *timeoutError) Temporary() bool { return true }
+
+// Session a mux connection
+type Session struct {
+	conn    net.Conn
+	writeMu sync.Mutex
+
+	mu      sync.Mutex
+	nextID  uint32
+	streams map[uint32]*Stream
+
+	accept    chan *Stream
+	closed    chan struct{}
+	closeOnce sync.Once
+	lastRecv  int64 // unix nano of the last frame received
+}
+
+// NewSession start serving frames on conn, streams opened by client
+// take odd IDs, the others take even IDs.
+func NewSession(conn net.Conn, client bool) *Session {
+	s := &Session{
+		conn:     conn,
+		nextID:   2,
+		streams:  make(map[uint32]*Stream),
+		accept:   make(chan *Stream, 64),
+		closed:   make(chan struct{}),
+		lastRecv: time.Now().UnixNano(),
+	}
+	if client {
+		s.nextID = 1
+	}
+	go s.recvLoop()
+	go s.keepalive(muxKeepAlive, muxIdleTimeout)
+	return s
+}
+
+// DialSession connect to server and start a client session
+func DialSession(network, addr string, cipher *Cipher) (*Session, error) {
+	c, err := connectToServer(network, addr, NewTraffic(TrafficMux, nil), cipher)
+	if err != nil {
+		return nil, err
+	}
+	return NewSession(c, true), nil
+}
+
+// Open a new stream to target rawaddr
+func (s *Session) Open(rawaddr []byte) (*Stream, error) {
+	return s.open(rawaddr, 0)
+}
+
+// OpenWithReply open a new stream, wait for the dial result
+func (s *Session) OpenWithReply(rawaddr []byte, flags uint8) (st *Stream, rep uint8, bound []byte, err error) {
+	if st, err = s.open(rawaddr, flags|FlagReply); err != nil {
+		return
+	}
+	setReadTimeout(st)
+	if rep, bound, err = ReadReply(st); err != nil {
+		st.Close()
+		return nil, 0, nil, err
+	}
+	return
+}
+
+func (s *Session) open(rawaddr []byte, flags uint8) (*Stream, error) {
+	s.mu.Lock()
+	if s.IsClosed() {
+		s.mu.Unlock()
+		return nil, ErrSessionClosed
+	}
+	st := newStream(s, s.nextID, rawaddr)
+	s.streams[st.id] = st
+	s.nextID += 2
+	s.mu.Unlock()
+
+	if err := s.writeFrame(TrafficOpen, flags, st.id, rawaddr); err != nil {
+		st.Close()
+		return nil, err
+	}
+	return st, nil
+}
+
+// Accept a stream opened by peer
+func (s *Session) Accept() (*Stream, error) {
+	select {
+	case st := <-s.accept:
+		return st, nil
+	case <-s.closed:
+		return nil, ErrSessionClosed
+	}
+}
+
+// NumStreams count of alive streams
+func (s *Session) NumStreams() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.streams)
+}
+
+func (s *Session) IsClosed() bool {
+	select {
+	case <-s.closed:
+		return true
+	default:
+		return false
+	}
+}
+
+// Close the session and all of its streams
+func (s *Session) Close() error {
+	s.closeOnce.Do(func() {
+		close(s.closed)
+		s.mu.Lock()
+		for _, st := range s.streams {
+			st.remoteClose()
+		}
+		s.mu.Unlock()
+	})
+	return s.conn.Close()
+}
+
+func (s *Session) writeFrame(tp TrafficType, flags uint8, id uint32, body []byte) error {
+	payload := make([]byte, lenStreamID+len(body))
+	binary.BigEndian.PutUint32(payload, id)
+	copy(payload[lenStreamID:], body)
+
+	t := NewTraffic(tp, payload)
+	t.Version = TrafficVersion2
+	t.Flags = flags
+
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+	if s.IsClosed() {
+		return ErrSessionClosed
+	}
+	_, err := s.conn.Write(t.Bytes())
+	return err
+}
+
+// keepalive ping peer, close the session once peer falls silent
+func (s *Session) keepalive(interval, timeout time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			last := time.Unix(0, atomic.LoadInt64(&s.lastRecv))
+			if time.Since(last) > timeout {
+				log.Println("[MUX] peer silent since", last, "close session")
+				s.Close()
+				return
+			}
+			// not blocking the check above if conn is stuck
+			go s.writeFrame(TrafficWindowUpdate, 0, 0, make([]byte, 4))
+		case <-s.closed:
+			return
+		}
+	}
+}
+
+func (s *Session) recvLoop() {
+	defer s.Close()
+	for {
+		t, err := UnMarshalTraffic(s.conn)
+		if err != nil {
+			if err != io.EOF && !s.IsClosed() {
+				log.Println("[MUX ERROR]", err)
+			}
+			return
+		}
+		atomic.StoreInt64(&s.lastRecv, time.Now().UnixNano())
+		if len(t.Payload) < lenStreamID {
+			log.Println("[MUX ERROR]", ErrBadFrame)
+			return
+		}
+		id := binary.BigEndian.Uint32(t.Payload)
+		body := t.Payload[lenStreamID:]
+
+		s.mu.Lock()
+		st := s.streams[id]
+		s.mu.Unlock()
+
+		switch t.Type {
+		case TrafficOpen:
+			if st != nil {
+				log.Println("[MUX ERROR] duplicated stream", id)
+				return
+			}
+			st = newStream(s, id, body)
+			st.WantReply = t.Flags&FlagReply != 0
+			s.mu.Lock()
+			s.streams[id] = st
+			s.mu.Unlock()
+			select {
+			case s.accept <- st:
+			default:
+				log.Println("[MUX] accept backlog full, reset stream", id)
+				st.Close()
+			}
+		case TrafficData:
+			if st != nil && !st.pushData(body) {
+				log.Println("[MUX] window exceeded, reset stream", id)
+				st.Close()
+			}
+		case TrafficClose:
+			if st != nil {
+				st.remoteClose()
+			}
+		case TrafficWindowUpdate:
+			if st != nil && len(body) == 4 {
+				st.addWindow(int(binary.BigEndian.Uint32(body)))
+			}
+		default:
+			log.Println("[MUX ERROR]", ErrUnknownType, t.Type)
+			return
+		}
+	}
+}
+
+func (s *Session) remove(id uint32) {
+	s.mu.Lock()
+	delete(s.streams, id)
+	s.mu.Unlock()
+}
+
+// Stream a logical connection in session
+type Stream struct {
+	session *Session
+	id      uint32
+	// Target rawaddr the stream was opened to
+	Target []byte
+	// WantReply peer wait for the dial result
+	WantReply bool
+
+	mu            sync.Mutex
+	buf           bytes.Buffer
+	consumed      int // read but not yet acknowledged by window update
+	sendWindow    int
+	localClosed   bool
+	remoteClosed  bool
+	readDeadline  time.Time
+	writeDeadline time.Time
+	readable      chan struct{}
+	writable      chan struct{}
+}
+
+func newStream(s *Session, id uint32, target []byte) *Stream {
+	return &Stream{
+		session:    s,
+		id:         id,
+		Target:     append([]byte(nil), target...),
+		sendWindow: initialWindow,
+		readable:   make(chan struct{}, 1),
+		writable:   make(chan struct{}, 1),
+	}
+}
+
+func notify(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
+
+// pushData buffer b, false if peer exceeds the window it was given
+func (st *Stream) pushData(b []byte) bool {
+	st.mu.Lock()
+	if st.buf.Len()+st.consumed+len(b) > initialWindow {
+		st.mu.Unlock()
+		return false
+	}
+	st.buf.Write(b)
+	st.mu.Unlock()
+	notify(st.readable)
+	return true
+}
+
+func (st *Stream) remoteClose() {
+	st.mu.Lock()
+	st.remoteClosed = true
+	st.mu.Unlock()
+	notify(st.readable)
+	notify(st.writable)
+}
+
+func (st *Stream) addWindow(n int) {
+	st.mu.Lock()
+	st.sendWindow += n
+	st.mu.Unlock()
+	notify(st.writable)
+}
+
+func (st *Stream) Read(b []byte) (n int, err error) {
+	for {
+		st.mu.Lock()
+		if st.buf.Len() > 0 {
+			n, _ = st.buf.Read(b)
+			st.consumed += n
+			var update int
+			if st.consumed >= initialWindow/2 {
+				update, st.consumed = st.consumed, 0
+			}
+			st.mu.Unlock()
+			if update > 0 {
+				inc := make([]byte, 4)
+				binary.BigEndian.PutUint32(inc, uint32(update))
+				st.session.writeFrame(TrafficWindowUpdate, 0, st.id, inc)
+			}
+			return
+		}
+		if st.remoteClosed || st.localClosed {
+			st.mu.Unlock()
+			return 0, io.EOF
+		}
+		deadline := st.readDeadline
+		st.mu.Unlock()
+
+		if err = st.wait(st.readable, deadline); err == ErrSessionClosed {
+			st.remoteClose()
+		} else if err != nil {
+			return 0, err
+		}
+	}
+}
+
+// wait for ch until deadline, or the session closed
+func (st *Stream) wait(ch chan struct{}, deadline time.Time) error {
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		d := time.Until(deadline)
+		if d <= 0 {
+			return errTimeout
+		}
+		timer := time.NewTimer(d)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	select {
+	case <-ch:
+		return nil
+	case <-timeout:
+		return errTimeout
+	case <-st.session.closed:
+		return ErrSessionClosed
+	}
+}
+
+func (st *Stream) Write(b []byte) (n int, err error) {
+	for len(b) > 0 {
+		st.mu.Lock()
+		if st.localClosed || st.remoteClosed {
+			st.mu.Unlock()
+			return n, ErrStreamClosed
+		}
+		deadline := st.writeDeadline
+		if !deadline.IsZero() && !time.Now().Before(deadline) {
+			st.mu.Unlock()
+			return n, errTimeout
+		}
+		if st.sendWindow <= 0 {
+			st.mu.Unlock()
+			if err = st.wait(st.writable, deadline); err != nil {
+				return n, err
+			}
+			continue
+		}
+		size := len(b)
+		if size > maxFrameData {
+			size = maxFrameData
+		}
+		if size > st.sendWindow {
+			size = st.sendWindow
+		}
+		st.sendWindow -= size
+		st.mu.Unlock()
+
+		if err = st.session.writeFrame(TrafficData, 0, st.id, b[:size]); err != nil {
+			return
+		}
+		n += size
+		b = b[size:]
+	}
+	return
+}
+
+// Close send close to peer and forget the stream
+func (st *Stream) Close() error {
+	st.mu.Lock()
+	if st.localClosed {
+		st.mu.Unlock()
+		return nil
+	}
+	st.localClosed = true
+	st.mu.Unlock()
+	notify(st.readable)
+	notify(st.writable)
+
+	st.session.remove(st.id)
+	return st.session.writeFrame(TrafficClose, 0, st.id, nil)
+}
+
+func (st *Stream) LocalAddr() net.Addr  { return st.session.conn.LocalAddr() }
+func (st *Stream) RemoteAddr() net.Addr { return st.session.conn.RemoteAddr() }
+
+func (st *Stream) SetDeadline(t time.Time) error {
+	st.SetReadDeadline(t)
+	return st.SetWriteDeadline(t)
+}
+func (st *Stream) SetReadDeadline(t time.Time) error {
+	st.mu.Lock()
+	st.readDeadline = t
+	st.mu.Unlock()
+	notify(st.readable)
+	return nil
+}
+func (st *Stream) SetWriteDeadline(t time.Time) error {
+	st.mu.Lock()
+	st.writeDeadline = t
+	st.mu.Unlock()
+	notify(st.writable)
+	return nil
+}
+
+// MuxPool keep a few sessions to server, open streams on the least busy one
+type MuxPool struct {
+	mu       sync.Mutex
+	sessions []*Session
+	dialing  []chan struct{} // closed when redial of the slot is done
+	network  string
+	addr     string
+	cipher   *Cipher
+}
+
+// NewMuxPool size sessions to be kept
+func NewMuxPool(size int, network, addr string, cipher *Cipher) *MuxPool {
+	return &MuxPool{
+		sessions: make([]*Session, size),
+		dialing:  make([]chan struct{}, size),
+		network:  network,
+		addr:     addr,
+		cipher:   cipher,
+	}
+}
+
+// Open a stream to rawaddr, wait for the dial result
+func (p *MuxPool) Open(rawaddr []byte, flags uint8) (*Stream, uint8, []byte, error) {
+	s, err := p.pick()
+	if err != nil {
+		return nil, 0, nil, err
+	}
+	return s.OpenWithReply(rawaddr, flags)
+}
+
+// pick the least busy live session, dead ones are redialed in background,
+// only when none is alive the caller waits for a redial.
+func (p *MuxPool) pick() (*Session, error) {
+	for {
+		var best *Session
+		var dead []int
+		var wait chan struct{}
+		p.mu.Lock()
+		for i, s := range p.sessions {
+			switch {
+			case s != nil && !s.IsClosed():
+				if best == nil || s.NumStreams() < best.NumStreams() {
+					best = s
+				}
+			case p.dialing[i] != nil:
+				wait = p.dialing[i]
+			default:
+				p.dialing[i] = make(chan struct{})
+				dead = append(dead, i)
+			}
+		}
+		p.mu.Unlock()
+
+		if best != nil {
+			for _, i := range dead {
+				go p.redial(i)
+			}
+			return best, nil
+		}
+		if len(dead) > 0 {
+			for _, i := range dead[1:] {
+				go p.redial(i)
+			}
+			return p.redial(dead[0])
+		}
+		<-wait
+	}
+}
+
+func (p *MuxPool) redial(i int) (*Session, error) {
+	s, err := DialSession(p.network, p.addr, p.cipher.Copy())
+	if err != nil {
+		log.Println("[MUX] dial error", p.addr, err)
+	}
+	p.mu.Lock()
+	if err == nil {
+		p.sessions[i] = s
+	}
+	done := p.dialing[i]
+	p.dialing[i] = nil
+	p.mu.Unlock()
+	close(done)
+	return s, err
+}
@@ -0,0 +1,74 @@
+package tnt
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestStreamWriteDeadline(t *testing.T) {
+	a, b := net.Pipe()
+	client, server := NewSession(a, true), NewSession(b, false)
+	defer client.Close()
+	defer server.Close()
+
+	st, err := client.Open([]byte("target"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	peer, err := server.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// peer never reads, the window closes
+	st.SetWriteDeadline(time.Now().Add(100 * time.Millisecond))
+	done := make(chan error, 1)
+	var n int
+	go func() {
+		n, err = st.Write(make([]byte, initialWindow+1))
+		done <- err
+	}()
+	select {
+	case err = <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("write blocked past deadline")
+	}
+	if e, ok := err.(net.Error); !ok || !e.Timeout() || n != initialWindow {
+		t.Fatalf("wrote %d, %v", n, err)
+	}
+
+	// a later deadline lets the write go on once peer reads
+	st.SetWriteDeadline(time.Time{})
+	go io.Copy(io.Discard, peer)
+	if _, err = st.Write([]byte("more")); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSessionKeepalive(t *testing.T) {
+	keepAlive, idle := muxKeepAlive, muxIdleTimeout
+	muxKeepAlive, muxIdleTimeout = 20*time.Millisecond, 60*time.Millisecond
+	defer func() { muxKeepAlive, muxIdleTimeout = keepAlive, idle }()
+
+	// idle sessions ping each other
+	a, b := net.Pipe()
+	client, server := NewSession(a, true), NewSession(b, false)
+	time.Sleep(200 * time.Millisecond)
+	if client.IsClosed() || server.IsClosed() {
+		t.Fatal("idle session closed")
+	}
+	client.Close()
+	server.Close()
+
+	// peer reads but never answers
+	a, b = net.Pipe()
+	defer b.Close()
+	go io.Copy(io.Discard, b)
+	client = NewSession(a, true)
+	time.Sleep(200 * time.Millisecond)
+	if !client.IsClosed() {
+		t.Fatal("silent peer not reaped")
+	}
+}
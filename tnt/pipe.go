@@ -10,6 +10,10 @@ import (
 
 const (
 	maxNBuf = 2048
+
+	typeIPv4   = uint8(1) // type is ipv4 address
+	typeDomain = uint8(3) // type is domain address
+	typeIPv6   = uint8(4) // type is ipv6 address
 )
 
 // Pipe ...
@@ -80,7 +84,7 @@ func HTTPProtocolHeader(domain string) []byte {
 // RawAddr according to domain and port
 func RawAddr(domain string, port uint16) []byte {
 	buf := new(bytes.Buffer)
-	buf.WriteByte(uint8(3))
+	buf.WriteByte(typeDomain)
 	buf.WriteByte(uint8(len(domain)))
 	buf.Write([]byte(domain))
 	binary.Write(buf, binary.BigEndian, port)
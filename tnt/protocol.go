@@ -3,8 +3,11 @@ package tnt
 import (
 	"bytes"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
+	"net"
+	"strconv"
 )
 
 type (
@@ -25,12 +28,16 @@ type (
 		RawAddr         []byte
 	}
 
-	// TrafficType 0: meaningless, 1: request, 2: response,  other: invalid
+	// TrafficType 0: meaningless, 1: request, 2-6: mux, 7-8: udp,
+	// 9: bind, 10: reply, 11: reverse, other: invalid
 	TrafficType uint8
 
 	// Traffic represent traffic throughout c/s
 	Traffic struct {
+		Version    uint8
 		Type       TrafficType
+		Flags      uint8
+		Timestamp  int64  // unix time, 0 if absent
 		PayloadLen uint16 // length of payload
 		Payload    []byte // rawaddr
 	}
@@ -39,15 +46,70 @@ type (
 const (
 	TrafficMeaningless TrafficType = iota
 	TrafficRequest
+	TrafficMux // begin a mux session, version 2 only
+	TrafficOpen
+	TrafficData
+	TrafficClose
+	TrafficWindowUpdate
+	TrafficUDPAssociate // begin an udp association, version 2 only
+	TrafficUDP
+	TrafficBind // version 2 only
+	TrafficReply
+	TrafficReverse // begin a reverse tunnel, version 2 only
+
+	trafficTypeMax = TrafficReverse
 )
 
+// versions of traffic header
+//
+// version 1 (legacy), first byte is the type:
+// | TYPE | [TIMESTAMP] | LEN | PAYLOAD |
+// |  1   |     8       |  2  |   LEN   |
+// an 8 bytes timestamp follows if the high bit of TYPE is set.
+//
+// version 2:
+// | VER | TYPE | FLAGS | LEN | [TIMESTAMP] | PAYLOAD |
+// |  1  |  1   |   1   |  2  |      8      |   LEN   |
+//
+// the first byte of version 1 is either 0x00, 0x01, 0x80 or 0x81,
+// so that server tells the version by the first byte.
 const (
-	layoutType       = 0
-	layoutPayloadLen = 1
-	layoutPayload    = 3
-	lenType          = 1
-	lenPayloadLen    = 2
-	requestBuf       = 269
+	TrafficVersion1 = uint8(1)
+	TrafficVersion2 = uint8(2)
+
+	// FlagTimestamp traffic carry a timestamp
+	FlagTimestamp = uint8(0x01)
+	// FlagReply client wait for a TrafficReply with the dial result
+	FlagReply = uint8(0x02)
+	// FlagForward request made by a static forward
+	FlagForward = uint8(0x04)
+	flagsKnown  = FlagTimestamp | FlagReply | FlagForward
+
+	v1Timestamp = 0x80 // flag on version 1 type
+
+	lenVersion    = 1
+	lenType       = 1
+	lenFlags      = 1
+	lenTimestamp  = 8
+	lenPayloadLen = 2
+
+	maxV1PayloadLen = 266 // 1addrType + 1addrLen + 255 + 2port, with room
+	// MaxPayloadLen upper bound of payload of version 2
+	MaxPayloadLen = 32 * 1024
+)
+
+var (
+	// TrafficTimestamp whether client stamp its traffic
+	TrafficTimestamp bool
+	// TrafficVersion header version client speaks
+	TrafficVersion = TrafficVersion2
+
+	ErrUnknownVersion  = errors.New("unknown traffic version")
+	ErrUnknownType     = errors.New("unknown traffic type")
+	ErrUnknownFlags    = errors.New("unknown traffic flags")
+	ErrPayloadTooLarge = errors.New("traffic payload too large")
+	ErrBadAddr         = errors.New("malformed address")
+	ErrUnsupported     = errors.New("unsupported on this platform")
 )
 
 func methodMeaning(n uint8) (result string) {
@@ -62,6 +124,8 @@ func methodMeaning(n uint8) (result string) {
 		result = "to X'7F' IANA ASSIGNED"
 	case 0x80:
 		result = "to X'FE' RESERVED FOR PRIVATE METHODS"
+	case 0xFF:
+		result = "NO ACCEPTABLE METHODS"
 	default:
 		result = `illegal method of ${n}`
 	}
@@ -105,6 +169,7 @@ func (s *Socks5Request) String() string {
 // rawaddr + payload
 func NewTraffic(tp TrafficType, payload []byte) (r *Traffic) {
 	return &Traffic{
+		Version:    TrafficVersion,
 		Type:       tp,
 		PayloadLen: uint16(len(payload)),
 		Payload:    payload,
@@ -113,39 +178,143 @@ func NewTraffic(tp TrafficType, payload []byte) (r *Traffic) {
 
 func (r *Traffic) Bytes() []byte {
 	buf := new(bytes.Buffer)
+	if r.Version == TrafficVersion1 {
+		if r.Timestamp != 0 {
+			buf.WriteByte(uint8(r.Type) | v1Timestamp)
+			binary.Write(buf, binary.BigEndian, r.Timestamp)
+		} else {
+			buf.WriteByte(uint8(r.Type))
+		}
+		binary.Write(buf, binary.BigEndian, r.PayloadLen)
+		buf.Write(r.Payload)
+		return buf.Bytes()
+	}
+
+	flags := r.Flags &^ FlagTimestamp
+	if r.Timestamp != 0 {
+		flags |= FlagTimestamp
+	}
+	buf.WriteByte(TrafficVersion2)
 	buf.WriteByte(uint8(r.Type))
+	buf.WriteByte(flags)
 	binary.Write(buf, binary.BigEndian, r.PayloadLen)
+	if r.Timestamp != 0 {
+		binary.Write(buf, binary.BigEndian, r.Timestamp)
+	}
 	buf.Write(r.Payload)
 	return buf.Bytes()
 }
 
-// UnMarshalTraffic unmarshal TNTrequest via conn
-func UnMarshalTraffic(conn io.Reader) (request *Traffic, err error) {
-	buf := make([]byte, requestBuf)
-
-	if _, err = io.ReadFull(conn, buf[:layoutType+lenType]); err != nil {
+// UnMarshalTraffic unmarshal traffic of either version via conn
+func UnMarshalTraffic(conn io.Reader) (traffic *Traffic, err error) {
+	buf := make([]byte, lenVersion+lenType+lenFlags+lenPayloadLen)
+	if _, err = io.ReadFull(conn, buf[:1]); err != nil {
 		return
 	}
-	tp := uint8(buf[layoutType])
-	if tp > uint8(TrafficRequest) {
-		err = fmt.Errorf("Invalid request type: %v", tp)
-		return
+
+	traffic = new(Traffic)
+	maxLen := MaxPayloadLen
+	switch first := buf[0]; {
+	case first == TrafficVersion2:
+		if _, err = io.ReadFull(conn, buf[1:]); err != nil {
+			return nil, err
+		}
+		traffic.Version = TrafficVersion2
+		traffic.Type = TrafficType(buf[1])
+		traffic.Flags = buf[2]
+		traffic.PayloadLen = binary.BigEndian.Uint16(buf[3:])
+		if traffic.Flags&^flagsKnown != 0 {
+			return nil, ErrUnknownFlags
+		}
+		if traffic.Flags&FlagTimestamp != 0 {
+			if traffic.Timestamp, err = readTimestamp(conn); err != nil {
+				return nil, err
+			}
+		}
+	case first&^v1Timestamp <= uint8(TrafficRequest):
+		traffic.Version = TrafficVersion1
+		traffic.Type = TrafficType(first &^ v1Timestamp)
+		if first&v1Timestamp != 0 {
+			traffic.Flags = FlagTimestamp
+			if traffic.Timestamp, err = readTimestamp(conn); err != nil {
+				return nil, err
+			}
+		}
+		if _, err = io.ReadFull(conn, buf[:lenPayloadLen]); err != nil {
+			return nil, err
+		}
+		traffic.PayloadLen = binary.BigEndian.Uint16(buf)
+		maxLen = maxV1PayloadLen
+	default:
+		return nil, ErrUnknownVersion
 	}
 
-	if _, err = io.ReadFull(conn, buf[layoutPayloadLen:layoutPayloadLen+lenPayloadLen]); err != nil {
-		return
+	if traffic.Type > trafficTypeMax {
+		return nil, ErrUnknownType
+	}
+	if int(traffic.PayloadLen) > maxLen {
+		return nil, ErrPayloadTooLarge
+	}
+	traffic.Payload = make([]byte, traffic.PayloadLen)
+	if _, err = io.ReadFull(conn, traffic.Payload); err != nil {
+		return nil, err
 	}
-	lenPayload := binary.BigEndian.Uint16(buf[layoutPayloadLen : layoutPayloadLen+lenPayloadLen])
+	return
+}
 
-	if _, err = io.ReadFull(conn, buf[layoutPayload:layoutPayload+lenPayload]); err != nil {
-		return
+func readTimestamp(conn io.Reader) (int64, error) {
+	buf := make([]byte, lenTimestamp)
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		return 0, err
 	}
-	payload := buf[layoutPayload : layoutPayload+lenPayload]
+	return int64(binary.BigEndian.Uint64(buf)), nil
+}
 
-	request = new(Traffic)
-	request.Type = TrafficType(tp)
-	request.PayloadLen = lenPayload
-	request.Payload = payload
+// ParseRawAddr parse socks5 style address
+// | ATYP | DST.ADDR | DST.PORT |
+// |  1   | Variable |    2     |
+// into host:port, the whole of b must be consumed.
+func ParseRawAddr(b []byte) (host string, err error) {
+	rawaddr, rest, err := SplitRawAddr(b)
+	if err != nil {
+		return
+	}
+	if len(rest) != 0 {
+		return "", ErrBadAddr
+	}
+	var address string
+	switch rawaddr[0] {
+	case typeIPv4, typeIPv6:
+		address = net.IP(rawaddr[1 : len(rawaddr)-2]).String()
+	case typeDomain:
+		address = string(rawaddr[2 : len(rawaddr)-2])
+	}
+	port := binary.BigEndian.Uint16(rawaddr[len(rawaddr)-2:])
+	return net.JoinHostPort(address, strconv.Itoa(int(port))), nil
+}
 
-	return
+// SplitRawAddr split the leading rawaddr from b
+func SplitRawAddr(b []byte) (rawaddr, rest []byte, err error) {
+	if len(b) < 1 {
+		return nil, nil, ErrBadAddr
+	}
+	var addrEnd int
+	switch b[0] {
+	case typeIPv4:
+		addrEnd = 1 + net.IPv4len
+	case typeIPv6:
+		addrEnd = 1 + net.IPv6len
+	case typeDomain:
+		// an empty domain would be dialed as localhost
+		if len(b) < 2 || b[1] == 0 {
+			return nil, nil, ErrBadAddr
+		}
+		addrEnd = 2 + int(b[1])
+	default:
+		return nil, nil, fmt.Errorf("address type is Unknown: %d", b[0])
+	}
+	if len(b) < addrEnd+2 {
+		return nil, nil, ErrBadAddr
+	}
+	return b[:addrEnd+2], b[addrEnd+2:], nil
 }
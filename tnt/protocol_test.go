@@ -0,0 +1,94 @@
+package tnt
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestParseRawAddr(t *testing.T) {
+	for _, c := range []struct {
+		raw  []byte
+		host string
+		ok   bool
+	}{
+		{[]byte{typeIPv4, 127, 0, 0, 1, 0, 80}, "127.0.0.1:80", true},
+		{append(append([]byte{typeIPv6}, make([]byte, 15)...), 1, 0x1f, 0x90), "[::1]:8080", true},
+		{append(append([]byte{typeDomain, 11}, "example.com"...), 1, 0xbb), "example.com:443", true},
+		{[]byte{typeDomain, 0, 0, 80}, "", false}, // empty domain
+		{[]byte{typeDomain}, "", false},
+		{[]byte{typeIPv4, 127, 0, 0, 1, 0}, "", false},
+		{[]byte{typeIPv4, 127, 0, 0, 1, 0, 80, 0}, "", false}, // trailing byte
+		{[]byte{2, 127, 0, 0, 1, 0, 80}, "", false},
+		{nil, "", false},
+	} {
+		host, err := ParseRawAddr(c.raw)
+		if (err == nil) != c.ok || host != c.host {
+			t.Errorf("%v: %q, %v", c.raw, host, err)
+		}
+	}
+}
+
+func TestSplitRawAddr(t *testing.T) {
+	raw := append([]byte{typeDomain, 1, 'a', 0, 53}, "data"...)
+	rawaddr, rest, err := SplitRawAddr(raw)
+	if err != nil || !bytes.Equal(rawaddr, raw[:5]) || string(rest) != "data" {
+		t.Fatalf("%v %q %v", rawaddr, rest, err)
+	}
+	host, err := AddrRawAddr("a:53")
+	if err != nil || !bytes.Equal(host, rawaddr) {
+		t.Fatalf("AddrRawAddr: %v %v", host, err)
+	}
+}
+
+func TestTrafficVersions(t *testing.T) {
+	payload := []byte{typeIPv4, 1, 2, 3, 4, 0, 80}
+	for _, c := range []struct {
+		version uint8
+		tp      TrafficType
+		flags   uint8
+		ts      int64
+		first   byte
+	}{
+		{TrafficVersion1, TrafficRequest, 0, 0, 0x01},
+		{TrafficVersion1, TrafficMeaningless, 0, 0, 0x00},
+		{TrafficVersion1, TrafficRequest, 0, 1234567890, 0x81},
+		{TrafficVersion2, TrafficRequest, FlagReply, 0, TrafficVersion2},
+		{TrafficVersion2, TrafficMux, FlagForward, 1234567890, TrafficVersion2},
+	} {
+		tr := &Traffic{Version: c.version, Type: c.tp, Flags: c.flags, Timestamp: c.ts,
+			PayloadLen: uint16(len(payload)), Payload: payload}
+		b := tr.Bytes()
+		if b[0] != c.first {
+			t.Errorf("version %d type %d: first byte %#x", c.version, c.tp, b[0])
+		}
+		got, err := UnMarshalTraffic(bytes.NewReader(b))
+		if err != nil {
+			t.Fatalf("version %d type %d: %v", c.version, c.tp, err)
+		}
+		wantFlags := c.flags
+		if c.ts != 0 {
+			wantFlags |= FlagTimestamp
+		}
+		if got.Version != c.version || got.Type != c.tp || got.Flags != wantFlags ||
+			got.Timestamp != c.ts || !bytes.Equal(got.Payload, payload) {
+			t.Errorf("version %d type %d: got %+v", c.version, c.tp, got)
+		}
+	}
+}
+
+func TestUnMarshalTrafficErrors(t *testing.T) {
+	for _, c := range []struct {
+		b   []byte
+		err error
+	}{
+		{[]byte{0x05, 0, 0, 0}, ErrUnknownVersion},
+		{[]byte{TrafficVersion2, byte(trafficTypeMax) + 1, 0, 0, 0}, ErrUnknownType},
+		{[]byte{TrafficVersion2, byte(TrafficRequest), 0x80, 0, 0}, ErrUnknownFlags},
+		{[]byte{TrafficVersion2, byte(TrafficData), 0, 0x80, 0x01}, ErrPayloadTooLarge},
+		{[]byte{0x01, 0x01, 0x0b}, ErrPayloadTooLarge}, // version 1 carries an address only
+	} {
+		if _, err := UnMarshalTraffic(bytes.NewReader(c.b)); err != c.err {
+			t.Errorf("%v: %v, want %v", c.b, err, c.err)
+		}
+	}
+}
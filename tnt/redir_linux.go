@@ -0,0 +1,150 @@
+//go:build linux
+// +build linux
+
+package tnt
+
+import (
+	"context"
+	"net"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	soOriginalDst     = 80 // SO_ORIGINAL_DST of netfilter
+	ip6tSoOriginalDst = 80 // IP6T_SO_ORIGINAL_DST
+)
+
+// OriginalDst destination of an iptables REDIRECTed connection
+func OriginalDst(conn net.Conn) (addr *net.TCPAddr, err error) {
+	tc, ok := conn.(*net.TCPConn)
+	if !ok {
+		return nil, ErrUnsupported
+	}
+	raw, err := tc.SyscallConn()
+	if err != nil {
+		return
+	}
+	ipv6 := tc.LocalAddr().(*net.TCPAddr).IP.To4() == nil
+
+	var serr error
+	err = raw.Control(func(fd uintptr) {
+		if ipv6 {
+			// sockaddr_in6 fits in ip6_mtuinfo
+			var info *unix.IPv6MTUInfo
+			if info, serr = unix.GetsockoptIPv6MTUInfo(int(fd), unix.IPPROTO_IPV6, ip6tSoOriginalDst); serr != nil {
+				return
+			}
+			port := (*[2]byte)(unsafe.Pointer(&info.Addr.Port))
+			addr = &net.TCPAddr{
+				IP:   append(net.IP(nil), info.Addr.Addr[:]...),
+				Port: int(port[0])<<8 | int(port[1]),
+			}
+			return
+		}
+		// sockaddr_in fits in ipv6_mreq
+		var mreq *unix.IPv6Mreq
+		if mreq, serr = unix.GetsockoptIPv6Mreq(int(fd), unix.IPPROTO_IP, soOriginalDst); serr != nil {
+			return
+		}
+		addr = &net.TCPAddr{
+			IP:   net.IPv4(mreq.Multiaddr[4], mreq.Multiaddr[5], mreq.Multiaddr[6], mreq.Multiaddr[7]),
+			Port: int(mreq.Multiaddr[2])<<8 | int(mreq.Multiaddr[3]),
+		}
+	})
+	if err == nil {
+		err = serr
+	}
+	return
+}
+
+func transparentControl(network, address string, c syscall.RawConn) (err error) {
+	var serr error
+	err = c.Control(func(fd uintptr) {
+		if serr = unix.SetsockoptInt(int(fd), unix.SOL_IP, unix.IP_TRANSPARENT, 1); serr != nil {
+			return
+		}
+		if network == "udp" || network == "udp4" || network == "udp6" {
+			if serr = unix.SetsockoptInt(int(fd), unix.SOL_IP, unix.IP_RECVORIGDSTADDR, 1); serr != nil {
+				return
+			}
+		}
+		// ipv4 only sockets refuse ipv6 options
+		unix.SetsockoptInt(int(fd), unix.SOL_IPV6, unix.IPV6_TRANSPARENT, 1)
+		unix.SetsockoptInt(int(fd), unix.SOL_IPV6, unix.IPV6_RECVORIGDSTADDR, 1)
+	})
+	if err == nil {
+		err = serr
+	}
+	return
+}
+
+// ListenTProxy listen tcp for TPROXY, original destination of accepted
+// connections is their LocalAddr
+func ListenTProxy(addr string) (net.Listener, error) {
+	lc := net.ListenConfig{Control: transparentControl}
+	return lc.Listen(context.Background(), "tcp", addr)
+}
+
+// ListenTProxyUDP listen udp for TPROXY
+func ListenTProxyUDP(addr string) (*net.UDPConn, error) {
+	lc := net.ListenConfig{Control: transparentControl}
+	pc, err := lc.ListenPacket(context.Background(), "udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return pc.(*net.UDPConn), nil
+}
+
+// ReadFromUDPWithDst read datagram with its original destination
+func ReadFromUDPWithDst(conn *net.UDPConn, b []byte) (n int, src, dst *net.UDPAddr, err error) {
+	oob := make([]byte, 64)
+	n, oobn, _, src, err := conn.ReadMsgUDP(b, oob)
+	if err != nil {
+		return
+	}
+	msgs, err := unix.ParseSocketControlMessage(oob[:oobn])
+	if err != nil {
+		return
+	}
+	for i := range msgs {
+		sa, err := unix.ParseOrigDstAddr(&msgs[i])
+		if err != nil {
+			continue
+		}
+		switch a := sa.(type) {
+		case *unix.SockaddrInet4:
+			return n, src, &net.UDPAddr{IP: net.IP(a.Addr[:]).To16(), Port: a.Port}, nil
+		case *unix.SockaddrInet6:
+			return n, src, &net.UDPAddr{IP: net.IP(a.Addr[:]), Port: a.Port}, nil
+		}
+	}
+	return n, src, nil, ErrBadAddr
+}
+
+// DialUDPFrom udp socket bound to a non-local laddr, so replies are sent
+// as from the original destination
+func DialUDPFrom(laddr, raddr *net.UDPAddr) (*net.UDPConn, error) {
+	d := net.Dialer{
+		LocalAddr: laddr,
+		Control: func(network, address string, c syscall.RawConn) (err error) {
+			var serr error
+			err = c.Control(func(fd uintptr) {
+				unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_REUSEADDR, 1)
+				serr = unix.SetsockoptInt(int(fd), unix.SOL_IP, unix.IP_TRANSPARENT, 1)
+				unix.SetsockoptInt(int(fd), unix.SOL_IPV6, unix.IPV6_TRANSPARENT, 1)
+			})
+			if err == nil {
+				err = serr
+			}
+			return
+		},
+	}
+	conn, err := d.Dial("udp", raddr.String())
+	if err != nil {
+		return nil, err
+	}
+	return conn.(*net.UDPConn), nil
+}
@@ -0,0 +1,33 @@
+//go:build !linux
+// +build !linux
+
+package tnt
+
+import (
+	"net"
+)
+
+// OriginalDst destination of an iptables REDIRECTed connection
+func OriginalDst(conn net.Conn) (*net.TCPAddr, error) {
+	return nil, ErrUnsupported
+}
+
+// ListenTProxy listen tcp for TPROXY
+func ListenTProxy(addr string) (net.Listener, error) {
+	return nil, ErrUnsupported
+}
+
+// ListenTProxyUDP listen udp for TPROXY
+func ListenTProxyUDP(addr string) (*net.UDPConn, error) {
+	return nil, ErrUnsupported
+}
+
+// ReadFromUDPWithDst read datagram with its original destination
+func ReadFromUDPWithDst(conn *net.UDPConn, b []byte) (n int, src, dst *net.UDPAddr, err error) {
+	return 0, nil, nil, ErrUnsupported
+}
+
+// DialUDPFrom udp socket bound to a non-local laddr
+func DialUDPFrom(laddr, raddr *net.UDPAddr) (*net.UDPConn, error) {
+	return nil, ErrUnsupported
+}
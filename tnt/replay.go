@@ -0,0 +1,102 @@
+package tnt
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+var (
+	ErrReplay     = errors.New("replayed salt")
+	ErrStaleTime  = errors.New("timestamp out of replay window")
+	DefaultWindow = 120 * time.Second
+)
+
+// replayLimit salts of a bucket, a full bucket rotates before its window
+const replayLimit = 1 << 18
+
+// ReplayFilter remember IVs/salts seen within recent windows.
+// Salts are kept in two buckets which rotate every window, so a salt
+// is remembered for at least one window, timestamps older than a window
+// should be rejected by CheckTime to cover the rest. Buckets are bounded,
+// under a flood of connections salts are forgotten sooner, which again
+// only timestamps cover.
+type ReplayFilter struct {
+	mu       sync.Mutex
+	window   time.Duration
+	limit    int
+	rotated  time.Time
+	current  map[string]struct{}
+	previous map[string]struct{}
+}
+
+func NewReplayFilter(window time.Duration) *ReplayFilter {
+	if window <= 0 {
+		window = DefaultWindow
+	}
+	return &ReplayFilter{
+		window:   window,
+		limit:    replayLimit,
+		rotated:  time.Now(),
+		current:  make(map[string]struct{}),
+		previous: make(map[string]struct{}),
+	}
+}
+
+// Seen whether salt has been seen, without remembering it, so that
+// connections are refused early but only remembered once authenticated
+func (f *ReplayFilter) Seen(salt []byte) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.rotate(time.Now())
+	return f.seen(string(salt))
+}
+
+// Check return false if salt has been seen, otherwise remember it
+func (f *ReplayFilter) Check(salt []byte) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	now := time.Now()
+	f.rotate(now)
+	key := string(salt)
+	if f.seen(key) {
+		return false
+	}
+	if len(f.current) >= f.limit {
+		f.previous = f.current
+		f.current = make(map[string]struct{})
+		f.rotated = now
+	}
+	f.current[key] = struct{}{}
+	return true
+}
+
+func (f *ReplayFilter) rotate(now time.Time) {
+	if now.Sub(f.rotated) < f.window {
+		return
+	}
+	f.previous = f.current
+	if now.Sub(f.rotated) >= 2*f.window {
+		f.previous = make(map[string]struct{})
+	}
+	f.current = make(map[string]struct{})
+	f.rotated = now
+}
+
+func (f *ReplayFilter) seen(key string) bool {
+	if _, ok := f.current[key]; ok {
+		return true
+	}
+	_, ok := f.previous[key]
+	return ok
+}
+
+// CheckTime whether unix timestamp falls into window
+func (f *ReplayFilter) CheckTime(ts int64) bool {
+	d := time.Since(time.Unix(ts, 0))
+	if d < 0 {
+		d = -d
+	}
+	return d <= f.window
+}
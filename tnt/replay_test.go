@@ -0,0 +1,117 @@
+package tnt
+
+import (
+	"crypto/rand"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestReplayFilter(t *testing.T) {
+	f := NewReplayFilter(100 * time.Millisecond)
+	a, b := []byte("salt a"), []byte("salt b")
+	if f.Seen(a) || !f.Check(a) {
+		t.Fatal("new salt refused")
+	}
+	if !f.Seen(a) || f.Check(a) {
+		t.Fatal("salt replayed")
+	}
+	if f.Seen(b) || f.Seen(b) || !f.Check(b) {
+		t.Fatal("Seen remembered salt")
+	}
+
+	// remembered through the next window, forgotten after two
+	time.Sleep(120 * time.Millisecond)
+	if f.Check(a) {
+		t.Fatal("salt forgotten after one window")
+	}
+	time.Sleep(220 * time.Millisecond)
+	if !f.Check(a) {
+		t.Fatal("salt kept after two windows")
+	}
+}
+
+func TestReplayFilterLimit(t *testing.T) {
+	f := NewReplayFilter(time.Hour)
+	f.limit = 4
+	for i := 0; i < 100; i++ {
+		if !f.Check([]byte{byte(i)}) {
+			t.Fatalf("salt %d refused", i)
+		}
+		if len(f.current) > f.limit || len(f.previous) > f.limit {
+			t.Fatalf("%d and %d salts kept", len(f.current), len(f.previous))
+		}
+		// a full bucket still remembers the latest ones
+		if i > 0 && f.Check([]byte{byte(i - 1)}) {
+			t.Fatalf("salt %d replayed", i-1)
+		}
+	}
+}
+
+func TestReplayFilterCheckTime(t *testing.T) {
+	f := NewReplayFilter(time.Minute)
+	now := time.Now().Unix()
+	for _, c := range []struct {
+		ts int64
+		ok bool
+	}{
+		{now, true},
+		{now - 59, true},
+		{now + 59, true},
+		{now - 61, false},
+		{now + 61, false},
+		{0, false},
+	} {
+		if f.CheckTime(c.ts) != c.ok {
+			t.Errorf("CheckTime(%d) != %v", c.ts-now, c.ok)
+		}
+	}
+}
+
+// salts of connections failing authentication are never remembered
+func TestConnReplayAfterAuth(t *testing.T) {
+	cipher, err := NewCipherWithKDF("aes-256-gcm", "pw", testKDF)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := NewReplayFilter(time.Minute)
+	serve := func(data []byte) error {
+		client, server := net.Pipe()
+		defer client.Close()
+		go func() {
+			client.Write(data)
+		}()
+		c := NewConn(server, cipher.Copy())
+		c.Replay = f
+		_, err := c.Read(make([]byte, 64))
+		return err
+	}
+
+	probe := make([]byte, 256)
+	rand.Read(probe)
+	if err = serve(probe); err == nil || err == ErrReplay {
+		t.Fatalf("probe: %v", err)
+	}
+	if len(f.current) != 0 {
+		t.Fatal("salt of probe remembered")
+	}
+
+	// record what a client sends
+	client, server := net.Pipe()
+	recorded := make(chan []byte)
+	go func() {
+		b, _ := io.ReadAll(server)
+		recorded <- b
+	}()
+	NewConn(client, cipher.Copy()).Write([]byte("hello"))
+	client.Close()
+	data := <-recorded
+
+	if err = serve(data); err != nil {
+		t.Fatal(err)
+	}
+	if err = serve(data); err != ErrReplay {
+		t.Fatalf("replay: %v", err)
+	}
+}
@@ -0,0 +1,102 @@
+package tnt
+
+import (
+	"errors"
+	"net"
+	"syscall"
+)
+
+// reply codes of socks5, server report them back through TrafficReply
+// | REP | ATYP | BND.ADDR | BND.PORT |
+// |  1  |  1   | Variable |    2     |
+const (
+	RepSucceeded           = uint8(0x00)
+	RepServerFailure       = uint8(0x01)
+	RepNotAllowed          = uint8(0x02)
+	RepNetworkUnreachable  = uint8(0x03)
+	RepHostUnreachable     = uint8(0x04)
+	RepConnectionRefused   = uint8(0x05)
+	RepTTLExpired          = uint8(0x06)
+	RepCommandNotSupported = uint8(0x07)
+	RepAddrNotSupported    = uint8(0x08)
+)
+
+var (
+	ErrNoReply = errors.New("expect reply traffic")
+	// ErrNotAllowed target refused by ruleset of server
+	ErrNotAllowed = errors.New("not allowed by ruleset")
+)
+
+// DialRep reply code according to the result of dial
+func DialRep(err error) uint8 {
+	if err == nil {
+		return RepSucceeded
+	}
+	if errors.Is(err, ErrNotAllowed) {
+		return RepNotAllowed
+	}
+	if errors.Is(err, syscall.ECONNREFUSED) {
+		return RepConnectionRefused
+	}
+	if errors.Is(err, syscall.ENETUNREACH) {
+		return RepNetworkUnreachable
+	}
+	if errors.Is(err, syscall.EHOSTUNREACH) {
+		return RepHostUnreachable
+	}
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		return RepHostUnreachable
+	}
+	if e, ok := err.(net.Error); ok && e.Timeout() {
+		return RepTTLExpired
+	}
+	return RepServerFailure
+}
+
+// ConnectWithReply write rawaddr to server, wait for the dial result
+func ConnectWithReply(network, addr string, rawaddr []byte, flags uint8, cipher *Cipher) (c *Conn, rep uint8, bound []byte, err error) {
+	t := NewTraffic(TrafficRequest, rawaddr)
+	t.Flags = flags | FlagReply
+	if c, err = connectToServer(network, addr, t, cipher); err != nil {
+		return
+	}
+	c.SetReadTimeout()
+	if rep, bound, err = ReadReply(c); err != nil {
+		c.Close()
+		return nil, 0, nil, err
+	}
+	return
+}
+
+// WriteReply send rep and address to peer
+func WriteReply(conn net.Conn, rep uint8, rawaddr []byte) error {
+	t := NewTraffic(TrafficReply, append([]byte{rep}, rawaddr...))
+	t.Version = TrafficVersion2
+	_, err := conn.Write(t.Bytes())
+	return err
+}
+
+// ReadReply receive rep and address from peer
+func ReadReply(conn net.Conn) (rep uint8, rawaddr []byte, err error) {
+	t, err := UnMarshalTraffic(conn)
+	if err != nil {
+		return
+	}
+	if t.Type != TrafficReply || len(t.Payload) < 1 {
+		return 0, nil, ErrNoReply
+	}
+	rawaddr, _, err = SplitRawAddr(t.Payload[1:])
+	return t.Payload[0], rawaddr, err
+}
+
+// AddrOf rawaddr of a tcp or udp address
+func AddrOf(addr net.Addr) []byte {
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		return IPRawAddr(a.IP, a.Port)
+	case *net.UDPAddr:
+		return IPRawAddr(a.IP, a.Port)
+	}
+	return IPRawAddr(net.IPv4zero, 0)
+}
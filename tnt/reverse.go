@@ -0,0 +1,91 @@
+package tnt
+
+import (
+	"log"
+	"net"
+	"time"
+)
+
+// Reverse tunnel expose a service behind client through server, like ssh -R.
+// It begins with a TrafficReverse whose payload is the rawaddr for server
+// to listen on, server answer with a TrafficReply of the bound address.
+// After that the connection is a mux session, in which server opens a
+// stream for every inbound connection, targeted at the inbound peer.
+
+// Reverse listen on Remote of server, connect inbound connections to Local
+type Reverse struct {
+	Remote string `json:"remote"`
+	Local  string `json:"local"`
+}
+
+// DialReverse ask server to listen on rawaddr, return the session
+// streams of inbound connections are accepted from.
+func DialReverse(network, addr string, rawaddr []byte, cipher *Cipher) (s *Session, rep uint8, bound []byte, err error) {
+	c, err := connectToServer(network, addr, NewTraffic(TrafficReverse, rawaddr), cipher)
+	if err != nil {
+		return
+	}
+	c.SetReadTimeout()
+	if rep, bound, err = ReadReply(c); err != nil {
+		c.Close()
+		return nil, 0, nil, err
+	}
+	if rep != RepSucceeded {
+		c.Close()
+		return
+	}
+	c.SetReadDeadline(time.Time{})
+	return NewSession(c, true), rep, bound, nil
+}
+
+// ServeReverse server side of a reverse tunnel, hand every connection
+// accepted on ln to client until the session closed.
+func ServeReverse(conn net.Conn, ln net.Listener) {
+	session := NewSession(conn, false)
+	defer session.Close()
+	go func() {
+		<-session.closed
+		ln.Close()
+	}()
+
+	for {
+		c, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		st, err := session.Open(AddrOf(c.RemoteAddr()))
+		if err != nil {
+			c.Close()
+			return
+		}
+		go func() {
+			defer c.Close()
+			defer st.Close()
+			go Pipe(c, st)
+			Pipe(st, c)
+		}()
+	}
+}
+
+// ReverseStreams accept streams of session, connect each to local,
+// return when the session closed.
+func ReverseStreams(session *Session, network, local string) {
+	defer session.Close()
+	for {
+		st, err := session.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer st.Close()
+			c, err := net.Dial(network, local)
+			if err != nil {
+				log.Println("[REVERSE] dial error", err)
+				return
+			}
+			defer c.Close()
+			go Pipe(st, c)
+			Pipe(c, st)
+		}()
+	}
+}
@@ -0,0 +1,307 @@
+package tnt
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Action of matched rule
+type Action uint8
+
+const (
+	ActionProxy Action = iota
+	ActionDirect
+	ActionReject
+)
+
+var actionNames = map[Action]string{
+	ActionProxy:  "proxy",
+	ActionDirect: "direct",
+	ActionReject: "reject",
+}
+
+func (a Action) String() string {
+	return actionNames[a]
+}
+
+func parseAction(s string) (Action, error) {
+	for a, name := range actionNames {
+		if strings.EqualFold(s, name) {
+			return a, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown action: %s", s)
+}
+
+// target being matched, its IPs are resolved at most once
+type target struct {
+	host     string
+	port     int
+	ip       net.IP
+	ips      []net.IP
+	resolved bool
+}
+
+func (t *target) lookup() []net.IP {
+	if t.ip != nil {
+		return []net.IP{t.ip}
+	}
+	if !t.resolved {
+		t.resolved = true
+		t.ips, _ = net.LookupIP(t.host)
+	}
+	return t.ips
+}
+
+type matcher func(t *target) bool
+
+type rule struct {
+	match  matcher
+	action Action
+}
+
+// Ruleset rules evaluated in order, the first matched decides the action.
+// Every line of rules file is "TYPE,VALUE,ACTION" or "FINAL,ACTION":
+//
+//	DOMAIN          exact host
+//	DOMAIN-SUFFIX   host or its subdomains
+//	DOMAIN-KEYWORD  host containing the keyword
+//	DOMAIN-REGEX    host matching the regular expression, ignoring case
+//	IP-CIDR         IP of host in the CIDR, append ",no-resolve" to
+//	                skip domains instead of resolving them. Resolving
+//	                asks the local DNS, even for hosts proxied later
+//	DST-PORT        port, or range like 8000-9000
+//	GEOIP           IP of host in the country, ",no-resolve" as IP-CIDR
+//	GEOSITE         host in the site list, "list@attr" for the domains
+//	                with the attribute only
+//	FINAL           action if none matched, defaults to proxy
+//
+// "geoip:CN,ACTION" and "geosite:google,ACTION" are short forms of GEOIP
+// and GEOSITE, which require the databases loaded before parsing.
+// blank lines and lines begin with "#" are ignored.
+type Ruleset struct {
+	rules []*rule
+	final Action
+}
+
+// ParseRules parse rules from r
+func ParseRules(r io.Reader) (*Ruleset, error) {
+	rs := &Ruleset{final: ActionProxy}
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Split(line, ",")
+		for i := range fields {
+			fields[i] = strings.TrimSpace(fields[i])
+		}
+		if err := rs.add(fields); err != nil {
+			return nil, fmt.Errorf("line %d: %v", n, err)
+		}
+	}
+	return rs, scanner.Err()
+}
+
+func (rs *Ruleset) add(fields []string) error {
+	if i := strings.IndexByte(fields[0], ':'); i > 0 {
+		fields = append([]string{fields[0][:i], fields[0][i+1:]}, fields[1:]...)
+	}
+	tp := strings.ToUpper(fields[0])
+	if tp == "FINAL" || tp == "MATCH" {
+		if len(fields) != 2 {
+			return fmt.Errorf("expect %s,ACTION", tp)
+		}
+		a, err := parseAction(fields[1])
+		rs.final = a
+		return err
+	}
+	if len(fields) < 3 {
+		return fmt.Errorf("expect TYPE,VALUE,ACTION")
+	}
+	value := fields[1]
+	action, err := parseAction(fields[2])
+	if err != nil {
+		return err
+	}
+	options := fields[3:]
+
+	var m matcher
+	switch tp {
+	case "DOMAIN":
+		value = strings.ToLower(value)
+		m = func(t *target) bool { return t.host == value }
+	case "DOMAIN-SUFFIX":
+		value = strings.ToLower(strings.TrimPrefix(value, "."))
+		m = func(t *target) bool {
+			return t.host == value || strings.HasSuffix(t.host, "."+value)
+		}
+	case "DOMAIN-KEYWORD":
+		value = strings.ToLower(value)
+		m = func(t *target) bool { return strings.Contains(t.host, value) }
+	case "DOMAIN-REGEX":
+		// host is lowercased, so must the pattern be
+		re, err := regexp.Compile("(?i)" + value)
+		if err != nil {
+			return err
+		}
+		m = func(t *target) bool { return re.MatchString(t.host) }
+	case "IP-CIDR", "IP-CIDR6":
+		_, ipnet, err := net.ParseCIDR(value)
+		if err != nil {
+			return err
+		}
+		m = ipMatcher(ipnet.Contains, options)
+	case "GEOIP":
+		contains, err := geoIPMatcher(value)
+		if err != nil {
+			return err
+		}
+		m = ipMatcher(contains, options)
+	case "GEOSITE":
+		contains, err := geoSiteMatcher(value)
+		if err != nil {
+			return err
+		}
+		m = func(t *target) bool { return t.ip == nil && contains(t.host) }
+	case "DST-PORT":
+		lo, hi, err := parsePortRange(value)
+		if err != nil {
+			return err
+		}
+		m = func(t *target) bool { return t.port >= lo && t.port <= hi }
+	default:
+		return fmt.Errorf("unknown rule type: %s", fields[0])
+	}
+	rs.rules = append(rs.rules, &rule{match: m, action: action})
+	return nil
+}
+
+// ipMatcher match IPs of target, domains are resolved unless no-resolve
+func ipMatcher(contains func(ip net.IP) bool, options []string) matcher {
+	noResolve := len(options) > 0 && strings.EqualFold(options[0], "no-resolve")
+	return func(t *target) bool {
+		if t.ip == nil && noResolve {
+			return false
+		}
+		for _, ip := range t.lookup() {
+			if contains(ip) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+func parsePortRange(s string) (lo, hi int, err error) {
+	parts := strings.SplitN(s, "-", 2)
+	if lo, err = strconv.Atoi(parts[0]); err != nil {
+		return
+	}
+	hi = lo
+	if len(parts) == 2 {
+		if hi, err = strconv.Atoi(parts[1]); err != nil {
+			return
+		}
+	}
+	if lo < 0 || hi > 65535 || lo > hi {
+		err = fmt.Errorf("invalid port range: %s", s)
+	}
+	return
+}
+
+// Match action of host:port
+func (rs *Ruleset) Match(hostport string) Action {
+	host, port, err := net.SplitHostPort(hostport)
+	if err != nil {
+		return rs.final
+	}
+	t := &target{host: strings.ToLower(host), ip: net.ParseIP(host)}
+	t.port, _ = strconv.Atoi(port)
+	for _, r := range rs.rules {
+		if r.match(t) {
+			return r.action
+		}
+	}
+	return rs.final
+}
+
+// Rules ruleset of file, reloaded once the file modified
+type Rules struct {
+	path  string
+	mu    sync.RWMutex
+	set   *Ruleset
+	mtime time.Time
+}
+
+// LoadRules load rules file
+func LoadRules(path string) (*Rules, error) {
+	r := &Rules{path: path}
+	if err := r.reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *Rules) reload() error {
+	f, err := os.Open(r.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	set, err := ParseRules(f)
+	if err != nil {
+		return fmt.Errorf("%s: %v", r.path, err)
+	}
+	r.mu.Lock()
+	r.set, r.mtime = set, info.ModTime()
+	r.mu.Unlock()
+	return nil
+}
+
+// Watch poll modification time of file every interval, reload on change,
+// the previous ruleset is kept if the new one fails to parse.
+func (r *Rules) Watch(interval time.Duration) {
+	for range time.Tick(interval) {
+		info, err := os.Stat(r.path)
+		if err != nil {
+			continue
+		}
+		r.mu.RLock()
+		changed := !info.ModTime().Equal(r.mtime)
+		r.mu.RUnlock()
+		if !changed {
+			continue
+		}
+		if err = r.reload(); err != nil {
+			log.Println("[RULES] reload error", err)
+			r.mu.Lock()
+			r.mtime = info.ModTime()
+			r.mu.Unlock()
+			continue
+		}
+		log.Println("[RULES] reloaded", r.path)
+	}
+}
+
+// Match action of host:port by current ruleset
+func (r *Rules) Match(hostport string) Action {
+	r.mu.RLock()
+	set := r.set
+	r.mu.RUnlock()
+	return set.Match(hostport)
+}
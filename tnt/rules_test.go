@@ -0,0 +1,84 @@
+package tnt
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseRulesErrors(t *testing.T) {
+	for _, line := range []string{
+		"DOMAIN,example.com",
+		"DOMAIN,example.com,tunnel",
+		"DOMAIN-REGEX,(,proxy",
+		"IP-CIDR,10.0.0.0/33,direct",
+		"DST-PORT,9000-8000,direct",
+		"DST-PORT,65536,direct",
+		"DST-PORT,x,direct",
+		"FINAL",
+		"FINAL,direct,reject",
+		"URL,example.com,proxy",
+	} {
+		if _, err := ParseRules(strings.NewReader(line)); err == nil {
+			t.Errorf("%q parsed", line)
+		}
+	}
+}
+
+func TestRulesetMatch(t *testing.T) {
+	rs, err := ParseRules(strings.NewReader(`
+# comment
+DOMAIN,Exact.Example.com,direct
+domain-suffix,.corp.example.com,direct
+DOMAIN-KEYWORD,ADS,reject
+DOMAIN-REGEX,^CDN[0-9]+\.example\.org$,proxy
+DOMAIN-REGEX,example\.org$,reject
+IP-CIDR,10.0.0.0/8,direct,no-resolve
+IP-CIDR,127.0.0.0/8,direct
+IP-CIDR6,fd00::/8,reject
+DST-PORT,25,reject
+DST-PORT,8000-9000,direct
+FINAL,Reject
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []struct {
+		hostport string
+		action   Action
+	}{
+		{"exact.example.com:443", ActionDirect},
+		{"EXACT.example.COM:443", ActionDirect},
+		{"corp.example.com:443", ActionDirect},
+		{"a.b.CORP.example.com:443", ActionDirect},
+		{"notcorp.example.com:443", ActionReject},
+		{"myads.net:80", ActionReject},
+		{"cdn12.example.org:443", ActionProxy},
+		{"CDN12.Example.org:443", ActionProxy},
+		{"cdnx.example.org:443", ActionReject},
+		{"10.1.2.3:443", ActionDirect},
+		{"localhost:443", ActionDirect}, // resolved
+		{"[fd00::1]:443", ActionReject},
+		{"[fe80::1]:8080", ActionDirect},
+		{"1.1.1.1:25", ActionReject},
+		{"1.1.1.1:8000", ActionDirect},
+		{"1.1.1.1:9001", ActionReject},
+		{"no port", ActionReject},
+	} {
+		if got := rs.Match(c.hostport); got != c.action {
+			t.Errorf("%s: %s, want %s", c.hostport, got, c.action)
+		}
+	}
+}
+
+func TestRulesetNoResolve(t *testing.T) {
+	rs, err := ParseRules(strings.NewReader("IP-CIDR,127.0.0.0/8,direct,no-resolve\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := rs.Match("localhost:80"); got != ActionProxy {
+		t.Fatalf("localhost: %s, domain resolved", got)
+	}
+	if got := rs.Match("127.0.0.1:80"); got != ActionDirect {
+		t.Fatalf("127.0.0.1: %s", got)
+	}
+}
@@ -0,0 +1,193 @@
+package tnt
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"errors"
+	"log"
+	"math/big"
+	"net"
+	"sync"
+	"time"
+)
+
+// TLSConfig optional TLS layer under every transport, so that the tunnel
+// looks like ordinary HTTPS to target_domain
+type TLSConfig struct {
+	// server, a self-signed certificate is generated if absent
+	Cert string `json:"cert"`
+	Key  string `json:"key"`
+	// client
+	ServerName         string   `json:"server_name"` // SNI, defaults to target_domain
+	Pins               []string `json:"pins"`        // base64 SHA-256 of SPKI
+	InsecureSkipVerify bool     `json:"insecure_skip_verify"`
+	// both
+	ALPN []string `json:"alpn"`
+}
+
+var (
+	ErrPinMismatch = errors.New("tls: certificate matches none of pins")
+
+	tlsConfig       *TLSConfig
+	tlsServerName   string
+	tlsServerOnce   sync.Once
+	tlsServerConfig *tls.Config
+	tlsServerErr    error
+)
+
+// setupTLS enable TLS layer if configured
+func setupTLS(config *Config) {
+	tlsConfig = config.TLS
+	if tlsConfig == nil {
+		return
+	}
+	if len(tlsConfig.ALPN) == 0 {
+		tlsConfig.ALPN = []string{"http/1.1"}
+		if config.Transport == "h2" {
+			tlsConfig.ALPN = []string{"h2"}
+		}
+	}
+	tlsServerName = tlsConfig.ServerName
+	if tlsServerName == "" {
+		tlsServerName = config.TargetDomain
+	}
+}
+
+// dialRaw connect to server, over TLS if enabled
+func dialRaw(network, addr string) (net.Conn, error) {
+	conn, err := net.Dial(network, addr)
+	if err != nil {
+		return nil, err
+	}
+	return clientTLS(conn)
+}
+
+// listenRaw listen for local, over TLS if enabled
+func listenRaw(network, addr string) (net.Listener, error) {
+	ln, err := net.Listen(network, addr)
+	if err != nil {
+		return nil, err
+	}
+	return serverTLS(ln)
+}
+
+// clientTLS handshake over conn if TLS enabled
+func clientTLS(conn net.Conn) (net.Conn, error) {
+	if tlsConfig == nil {
+		return conn, nil
+	}
+	c := tls.Client(conn, clientTLSConfig())
+	setReadTimeout(conn)
+	if err := c.Handshake(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetReadDeadline(time.Time{})
+	return c, nil
+}
+
+// serverTLS wrap ln if TLS enabled
+func serverTLS(ln net.Listener) (net.Listener, error) {
+	if tlsConfig == nil {
+		return ln, nil
+	}
+	tlsServerOnce.Do(func() {
+		tlsServerConfig, tlsServerErr = serverTLSConfig()
+	})
+	if tlsServerErr != nil {
+		ln.Close()
+		return nil, tlsServerErr
+	}
+	return tls.NewListener(ln, tlsServerConfig), nil
+}
+
+func clientTLSConfig() *tls.Config {
+	c := &tls.Config{
+		ServerName:         tlsServerName,
+		NextProtos:         tlsConfig.ALPN,
+		InsecureSkipVerify: tlsConfig.InsecureSkipVerify,
+	}
+	if len(tlsConfig.Pins) > 0 {
+		// pins take the place of CA verification
+		c.InsecureSkipVerify = true
+		c.VerifyConnection = func(cs tls.ConnectionState) error {
+			if len(cs.PeerCertificates) == 0 {
+				return ErrPinMismatch
+			}
+			pin := SPKIPin(cs.PeerCertificates[0])
+			for _, p := range tlsConfig.Pins {
+				if p == pin {
+					return nil
+				}
+			}
+			return ErrPinMismatch
+		}
+	}
+	return c
+}
+
+func serverTLSConfig() (*tls.Config, error) {
+	var cert tls.Certificate
+	var err error
+	if tlsConfig.Cert != "" {
+		cert, err = tls.LoadX509KeyPair(tlsConfig.Cert, tlsConfig.Key)
+	} else {
+		cert, err = selfSigned(tlsServerName)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if cert.Leaf == nil {
+		if cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+			return nil, err
+		}
+	}
+	log.Println("[TLS] certificate of", cert.Leaf.Subject.CommonName, "pin:", SPKIPin(cert.Leaf))
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		NextProtos:   tlsConfig.ALPN,
+	}, nil
+}
+
+// SPKIPin base64 SHA-256 of the SubjectPublicKeyInfo of cert
+func SPKIPin(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// selfSigned generate certificate of host for testing
+func selfSigned(host string) (tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: host},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().AddDate(1, 0, 0),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		tmpl.IPAddresses = []net.IP{ip}
+	} else {
+		tmpl.DNSNames = []string{host}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, nil
+}
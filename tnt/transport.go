@@ -0,0 +1,173 @@
+package tnt
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"sort"
+	"sync"
+)
+
+// Transport carry tunnel connections between local and server,
+// whatever it wraps, the tunnel sees a plain net.Conn.
+type Transport interface {
+	Dial(network, addr string) (net.Conn, error)
+	Listen(network, addr string) (net.Listener, error)
+}
+
+var (
+	transportLock sync.RWMutex
+	transports    = map[string]func(config *Config) (Transport, error){
+		"tcp": func(*Config) (Transport, error) { return tcpTransport{}, nil },
+	}
+
+	// CurrentTransport transport of tunnel, set by ParseConfig
+	CurrentTransport Transport = tcpTransport{}
+)
+
+// RegisterTransport make transport available by name in config
+func RegisterTransport(name string, fn func(config *Config) (Transport, error)) {
+	transportLock.Lock()
+	defer transportLock.Unlock()
+	transports[name] = fn
+}
+
+// ListTransports names of supported transports
+func ListTransports() []string {
+	transportLock.RLock()
+	defer transportLock.RUnlock()
+	names := make([]string, 0, len(transports))
+	for name := range transports {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// NewTransport transport named in config, tcp if empty
+func NewTransport(config *Config) (Transport, error) {
+	name := config.Transport
+	if name == "" {
+		name = "tcp"
+	}
+	transportLock.RLock()
+	fn, ok := transports[name]
+	transportLock.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("unsupported transport: %s", name)
+	}
+	return fn(config)
+}
+
+// Dial server through current transport
+func Dial(network, addr string) (net.Conn, error) {
+	return CurrentTransport.Dial(network, addr)
+}
+
+// Listen for local through current transport
+func Listen(network, addr string) (net.Listener, error) {
+	return CurrentTransport.Listen(network, addr)
+}
+
+type tcpTransport struct{}
+
+func (tcpTransport) Dial(network, addr string) (net.Conn, error) {
+	return dialRaw(network, addr)
+}
+
+func (tcpTransport) Listen(network, addr string) (net.Listener, error) {
+	return listenRaw(network, addr)
+}
+
+// chanListener listener of connections pushed by transport
+type chanListener struct {
+	addr    net.Addr
+	onClose func() error
+	conns   chan net.Conn
+	closed  chan struct{}
+	once    sync.Once
+	err     error
+}
+
+func newChanListener(ln net.Listener) *chanListener {
+	l := newChanListenerAddr(ln.Addr())
+	l.onClose = ln.Close
+	return l
+}
+
+func newChanListenerAddr(addr net.Addr) *chanListener {
+	return &chanListener{
+		addr:   addr,
+		conns:  make(chan net.Conn),
+		closed: make(chan struct{}),
+	}
+}
+
+// push c to Accept, close it if listener closed
+func (l *chanListener) push(c net.Conn) {
+	select {
+	case l.conns <- c:
+	case <-l.closed:
+		c.Close()
+	}
+}
+
+// fail close listener, Accept return err from now on unless closed already
+func (l *chanListener) fail(err error) {
+	l.once.Do(func() {
+		l.err = err
+		close(l.closed)
+	})
+	l.Close()
+}
+
+func (l *chanListener) Accept() (net.Conn, error) {
+	select {
+	case c := <-l.conns:
+		return c, nil
+	case <-l.closed:
+		if l.err != nil {
+			return nil, l.err
+		}
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *chanListener) Close() error {
+	l.once.Do(func() { close(l.closed) })
+	if l.onClose != nil {
+		return l.onClose()
+	}
+	return nil
+}
+
+func (l *chanListener) Addr() net.Addr {
+	return l.addr
+}
+
+// wrapListener accept connections whose wrapping handshake has been done
+// by wrap in its own goroutine, so that slow peers never block others.
+func wrapListener(ln net.Listener, wrap func(net.Conn) (net.Conn, error)) net.Listener {
+	l := newChanListener(ln)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				l.fail(err)
+				return
+			}
+			go func() {
+				c, err := wrap(conn)
+				if err != nil {
+					if err != ErrNotTunnel {
+						log.Println("[TRANSPORT] handshake error", conn.RemoteAddr(), err)
+						conn.Close()
+					}
+					return
+				}
+				l.push(c)
+			}()
+		}
+	}()
+	return l
+}
@@ -0,0 +1,353 @@
+package tnt
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"net/http/httputil"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+// h2 transport carry every tunnel connection in a bidirectional POST,
+// which is a stream of a shared HTTP/2 connection, the request body is
+// the upstream and the response body is the downstream. HTTP/2 runs over
+// the TLS layer if enabled, otherwise in cleartext (h2c).
+
+const h2ContentType = "application/grpc"
+
+func init() {
+	RegisterTransport("h2", func(config *Config) (Transport, error) {
+		path := config.H2Path
+		if path == "" {
+			path = "/"
+		}
+		t := &h2Transport{
+			host:     config.TargetDomain,
+			path:     path,
+			fallback: net.JoinHostPort(config.TargetDomain, strconv.Itoa(int(config.TargetPort))),
+		}
+		t.client = &http2.Transport{
+			AllowHTTP: true,
+			DialTLSContext: func(ctx context.Context, network, addr string, _ *tls.Config) (net.Conn, error) {
+				return dialRaw(network, addr)
+			},
+			ReadIdleTimeout: 30 * time.Second,
+		}
+		return t, nil
+	})
+}
+
+type h2Transport struct {
+	host     string
+	path     string
+	fallback string
+	client   *http2.Transport
+}
+
+func (t *h2Transport) Dial(network, addr string) (net.Conn, error) {
+	scheme := "http"
+	if tlsConfig != nil {
+		scheme = "https"
+	}
+	pr, pw := io.Pipe()
+	// connections are pooled by URL, so that each server has its own
+	req, err := http.NewRequest(http.MethodPost, scheme+"://"+addr+t.path, pr)
+	if err != nil {
+		return nil, err
+	}
+	req.Host = t.host
+	req.Header.Set("Content-Type", h2ContentType)
+	req.Header.Set("User-Agent", httpUserAgent)
+
+	c := &h2Conn{w: pw, local: &net.TCPAddr{}, remote: &net.TCPAddr{}}
+	ctx, cancel := context.WithCancel(context.Background())
+	c.cancel = cancel
+	ctx = httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			c.local, c.remote = info.Conn.LocalAddr(), info.Conn.RemoteAddr()
+		},
+	})
+	if ReadTimeout > 0 {
+		timer := time.AfterFunc(ReadTimeout, cancel)
+		defer timer.Stop()
+	}
+
+	resp, err := t.client.RoundTrip(req.WithContext(ctx))
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		cancel()
+		return nil, fmt.Errorf("unexpected response: %s", resp.Status)
+	}
+	c.r = resp.Body
+	c.closeRead = resp.Body.Close
+	return c, nil
+}
+
+func (t *h2Transport) Listen(network, addr string) (net.Listener, error) {
+	ln, err := listenRaw(network, addr)
+	if err != nil {
+		return nil, err
+	}
+	decoy := httputil.NewSingleHostReverseProxy(&url.URL{Scheme: "http", Host: t.fallback})
+	h := NewH2Handler(t.path, decoy)
+	h.addr, h.onClose = ln.Addr(), ln.Close
+
+	srv := &http.Server{
+		Handler:           h,
+		ReadHeaderTimeout: ReadTimeout,
+		ErrorLog:          log.New(ioutil.Discard, "", 0),
+	}
+	if tlsConfig != nil {
+		if err = http2.ConfigureServer(srv, nil); err != nil {
+			ln.Close()
+			return nil, err
+		}
+	} else {
+		srv.Handler = h2c.NewHandler(h, &http2.Server{})
+	}
+	go func() {
+		h.fail(srv.Serve(ln))
+	}()
+	return h, nil
+}
+
+// H2Handler accept tunnels of h2 transport on Path, other requests go to
+// Decoy. It can be mounted behind any http.Server speaking HTTP/2, and
+// tunnels are taken by Accept as a net.Listener.
+type H2Handler struct {
+	*chanListener
+	Path  string
+	Decoy http.Handler
+}
+
+// NewH2Handler handler of tunnels on path
+func NewH2Handler(path string, decoy http.Handler) *H2Handler {
+	return &H2Handler{
+		chanListener: newChanListenerAddr(&net.TCPAddr{}),
+		Path:         path,
+		Decoy:        decoy,
+	}
+}
+
+func (h *H2Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.ProtoMajor != 2 || r.Method != http.MethodPost || r.URL.Path != h.Path ||
+		r.Header.Get("Content-Type") != h2ContentType {
+		h.Decoy.ServeHTTP(w, r)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		h.Decoy.ServeHTTP(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", h2ContentType)
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	rc := http.NewResponseController(w)
+	c := &h2Conn{
+		r:         r.Body,
+		w:         &flushWriter{w: w, f: flusher},
+		closeRead: r.Body.Close,
+		rc:        rc,
+		local:     &net.TCPAddr{},
+		remote:    &net.TCPAddr{},
+		done:      make(chan struct{}),
+	}
+	if addr, ok := r.Context().Value(http.LocalAddrContextKey).(net.Addr); ok {
+		c.local = addr
+	}
+	if addr, err := net.ResolveTCPAddr("tcp", r.RemoteAddr); err == nil {
+		c.remote = addr
+	}
+	h.push(c)
+
+	// the stream lives as long as the handler, w must not be touched after
+	select {
+	case <-c.done:
+	case <-r.Context().Done():
+		c.mu.Lock()
+		c.closed = true
+		c.mu.Unlock()
+	}
+}
+
+type flushWriter struct {
+	w io.Writer
+	f http.Flusher
+}
+
+func (fw *flushWriter) Write(b []byte) (int, error) {
+	n, err := fw.w.Write(b)
+	fw.f.Flush()
+	return n, err
+}
+
+// h2Conn net.Conn of a stream
+type h2Conn struct {
+	r         io.Reader
+	w         io.Writer
+	closeRead func() error
+	cancel    context.CancelFunc       // client
+	rc        *http.ResponseController // server
+	local     net.Addr
+	remote    net.Addr
+
+	mu     sync.Mutex
+	closed bool
+	done   chan struct{}
+
+	// client deadlines, apart from mu which is held by blocked writes
+	tmu     sync.Mutex
+	stopped bool
+	expired bool // a deadline has torn the stream down
+	rtimer  *time.Timer
+	wtimer  *time.Timer
+}
+
+var errH2Closed = errors.New("h2 stream closed")
+
+func (c *h2Conn) Read(b []byte) (int, error) {
+	n, err := c.r.Read(b)
+	if err != nil && c.timedOut() {
+		err = errTimeout
+	}
+	return n, err
+}
+
+func (c *h2Conn) Write(b []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return 0, errH2Closed
+	}
+	n, err := c.w.Write(b)
+	if err != nil && c.timedOut() {
+		err = errTimeout
+	}
+	return n, err
+}
+
+func (c *h2Conn) timedOut() bool {
+	c.tmu.Lock()
+	defer c.tmu.Unlock()
+	return c.expired
+}
+
+func (c *h2Conn) Close() error {
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return nil
+	}
+	c.closed = true
+	c.mu.Unlock()
+	c.tmu.Lock()
+	c.stopped = true
+	c.stopTimers()
+	c.tmu.Unlock()
+
+	if wc, ok := c.w.(io.Closer); ok {
+		wc.Close()
+	}
+	c.closeRead()
+	if c.cancel != nil {
+		c.cancel()
+	}
+	if c.done != nil {
+		close(c.done)
+	}
+	return nil
+}
+
+func (c *h2Conn) LocalAddr() net.Addr  { return c.local }
+func (c *h2Conn) RemoteAddr() net.Addr { return c.remote }
+
+func (c *h2Conn) SetDeadline(t time.Time) error {
+	if err := c.SetReadDeadline(t); err != nil {
+		return err
+	}
+	return c.SetWriteDeadline(t)
+}
+
+// server side deadlines are those of the response, client side ones can
+// not interrupt a blocked body, so the stream is torn down when they pass
+func (c *h2Conn) SetReadDeadline(t time.Time) error {
+	if c.rc == nil {
+		c.tmu.Lock()
+		c.rtimer = c.expireAt(c.rtimer, t, c.closeRead)
+		c.tmu.Unlock()
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return nil
+	}
+	return c.rc.SetReadDeadline(t)
+}
+
+func (c *h2Conn) SetWriteDeadline(t time.Time) error {
+	if c.rc == nil {
+		c.tmu.Lock()
+		c.wtimer = c.expireAt(c.wtimer, t, func() error {
+			c.cancel()
+			return nil
+		})
+		c.tmu.Unlock()
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return nil
+	}
+	return c.rc.SetWriteDeadline(t)
+}
+
+// expireAt replace timer with one calling abort at t, none if t is zero,
+// tmu held
+func (c *h2Conn) expireAt(timer *time.Timer, t time.Time, abort func() error) *time.Timer {
+	if timer != nil {
+		timer.Stop()
+	}
+	if t.IsZero() || c.stopped || c.expired {
+		return nil
+	}
+	return time.AfterFunc(time.Until(t), func() {
+		c.tmu.Lock()
+		if c.stopped {
+			c.tmu.Unlock()
+			return
+		}
+		c.expired = true
+		c.tmu.Unlock()
+		abort()
+	})
+}
+
+func (c *h2Conn) stopTimers() {
+	if c.rtimer != nil {
+		c.rtimer.Stop()
+	}
+	if c.wtimer != nil {
+		c.wtimer.Stop()
+	}
+}
@@ -0,0 +1,196 @@
+package tnt
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// http transport wrap the tunnel in one HTTP/1.1 exchange, client POST
+// a chunked body carrying the upstream, server answer with a chunked
+// response carrying the downstream. Requests not of tunnel, such as
+// those of browsers, are relayed to the fallback address untouched.
+
+var ErrNotTunnel = errors.New("not a tunnel request")
+
+const httpUserAgent = "Mozilla/5.0 (Macintosh; Intel Mac OS X 10_11_6)"
+
+func init() {
+	RegisterTransport("http", func(config *Config) (Transport, error) {
+		path := config.HTTPPath
+		if path == "" {
+			path = "/"
+		}
+		return &httpTransport{
+			host:     config.TargetDomain,
+			path:     path,
+			fallback: net.JoinHostPort(config.TargetDomain, strconv.Itoa(int(config.TargetPort))),
+		}, nil
+	})
+}
+
+type httpTransport struct {
+	host     string
+	path     string
+	fallback string
+}
+
+func (t *httpTransport) Dial(network, addr string) (net.Conn, error) {
+	conn, err := dialRaw(network, addr)
+	if err != nil {
+		return nil, err
+	}
+	c, err := t.Client(conn)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// Client send request on conn, wait for the response
+func (t *httpTransport) Client(conn net.Conn) (net.Conn, error) {
+	req := fmt.Sprintf("POST %s HTTP/1.1\r\n"+
+		"Host: %s\r\n"+
+		"User-Agent: %s\r\n"+
+		"Content-Type: application/octet-stream\r\n"+
+		"Transfer-Encoding: chunked\r\n\r\n", t.path, t.host, httpUserAgent)
+	if _, err := conn.Write([]byte(req)); err != nil {
+		return nil, err
+	}
+
+	setReadTimeout(conn)
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, nil)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK || !chunked(resp.TransferEncoding) {
+		return nil, fmt.Errorf("unexpected response: %s", resp.Status)
+	}
+	conn.SetReadDeadline(time.Time{})
+	return newHTTPConn(conn, br), nil
+}
+
+func (t *httpTransport) Listen(network, addr string) (net.Listener, error) {
+	ln, err := listenRaw(network, addr)
+	if err != nil {
+		return nil, err
+	}
+	return wrapListener(ln, t.Server), nil
+}
+
+// Server read request from conn, answer it if of tunnel, otherwise relay
+// conn to fallback and return ErrNotTunnel, malformed requests included.
+func (t *httpTransport) Server(conn net.Conn) (net.Conn, error) {
+	rec := &recordReader{r: conn, buf: new(bytes.Buffer)}
+	br := bufio.NewReader(rec)
+	setReadTimeout(conn)
+	req, err := http.ReadRequest(br)
+	if err != nil || req.Method != http.MethodPost || req.URL.Path != t.path || !chunked(req.TransferEncoding) {
+		go fallback(conn, t.fallback, rec.buf.Bytes())
+		return nil, ErrNotTunnel
+	}
+	resp := "HTTP/1.1 200 OK\r\n" +
+		"Content-Type: application/octet-stream\r\n" +
+		"Cache-Control: no-store\r\n" +
+		"Transfer-Encoding: chunked\r\n\r\n"
+	if _, err = conn.Write([]byte(resp)); err != nil {
+		return nil, err
+	}
+	conn.SetReadDeadline(time.Time{})
+	rec.buf = nil
+	return newHTTPConn(conn, br), nil
+}
+
+// recordReader keep what has been read in buf unless buf is nil
+type recordReader struct {
+	r   io.Reader
+	buf *bytes.Buffer
+}
+
+func (r *recordReader) Read(b []byte) (int, error) {
+	n, err := r.r.Read(b)
+	if r.buf != nil {
+		r.buf.Write(b[:n])
+	}
+	return n, err
+}
+
+func chunked(te []string) bool {
+	return len(te) > 0 && te[0] == "chunked"
+}
+
+// fallback relay conn to addr, replaying what has been read
+func fallback(conn net.Conn, addr string, read []byte) {
+	defer conn.Close()
+	remote, err := net.Dial("tcp", addr)
+	if err != nil {
+		log.Println("[FALLBACK] dial error", err)
+		return
+	}
+	defer remote.Close()
+	if _, err = remote.Write(read); err != nil {
+		return
+	}
+	conn.SetReadDeadline(time.Time{})
+	go Pipe(conn, remote)
+	Pipe(remote, conn)
+}
+
+// httpConn read and write chunked body
+type httpConn struct {
+	net.Conn
+	r io.Reader
+
+	mu     sync.Mutex
+	closed bool
+}
+
+func newHTTPConn(conn net.Conn, br *bufio.Reader) *httpConn {
+	return &httpConn{Conn: conn, r: httputil.NewChunkedReader(br)}
+}
+
+func (c *httpConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+// Write every b as a chunk
+func (c *httpConn) Write(b []byte) (int, error) {
+	if len(b) == 0 {
+		return 0, nil
+	}
+	chunk := make([]byte, 0, len(b)+16)
+	chunk = strconv.AppendInt(chunk, int64(len(b)), 16)
+	chunk = append(chunk, "\r\n"...)
+	chunk = append(chunk, b...)
+	chunk = append(chunk, "\r\n"...)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, err := c.Conn.Write(chunk); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// Close end the body, then the connection
+func (c *httpConn) Close() error {
+	c.mu.Lock()
+	if !c.closed {
+		c.closed = true
+		c.Conn.SetWriteDeadline(time.Now().Add(time.Second))
+		c.Conn.Write([]byte("0\r\n\r\n"))
+	}
+	c.mu.Unlock()
+	return c.Conn.Close()
+}
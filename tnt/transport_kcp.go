@@ -0,0 +1,527 @@
+package tnt
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// kcp transport carry every tunnel connection in an ARQ session over UDP,
+// which recovers from loss much faster than TCP at the cost of bandwidth,
+// optionally with FEC so that most losses need no retransmission at all.
+// Sessions are told apart by remote address, the first PUSH opens one.
+// Since the source of that PUSH may be spoofed, a new session sends no
+// more than kcpAmplification times what it received, until the peer
+// echoes the timestamp of a segment, which starts at a random clock.
+// Client pads its packets to mtu till it hears from server, so that the
+// first flight of server is never held back.
+
+// KCPConfig tunables of kcp transport, must be the same on both ends
+type KCPConfig struct {
+	MTU          int  `json:"mtu"`           // UDP payload, defaults to 1350
+	SndWnd       int  `json:"snd_wnd"`       // segments, defaults to 128
+	RcvWnd       int  `json:"rcv_wnd"`       // segments, defaults to 512
+	DataShards   int  `json:"data_shards"`   // FEC disabled if 0
+	ParityShards int  `json:"parity_shards"` // FEC disabled if 0
+	NoDelay      bool `json:"nodelay"`
+	Interval     int  `json:"interval"` // ms, defaults to 20 for nodelay, 40 otherwise
+	Resend       int  `json:"resend"`   // fast resend after duplicated ACKs, defaults to 2 for nodelay
+	NoCongestion bool `json:"nc"`
+}
+
+const (
+	kcpKeepalive = 10 * time.Second
+	kcpIdle      = 60 * time.Second // peer is gone if nothing heard
+	kcpBufSize   = 65536
+
+	kcpAmplification = 3
+)
+
+var (
+	ErrKCPDeadLink = errors.New("kcp: peer unreachable")
+	ErrKCPIdle     = errors.New("kcp: peer idle timeout")
+
+	kcpEpoch = time.Now()
+)
+
+func init() {
+	RegisterTransport("kcp", func(config *Config) (Transport, error) {
+		c := KCPConfig{}
+		if config.KCP != nil {
+			c = *config.KCP
+		}
+		if c.MTU == 0 {
+			c.MTU = 1350
+		}
+		if c.SndWnd == 0 {
+			c.SndWnd = 128
+		}
+		if c.RcvWnd == 0 {
+			c.RcvWnd = 512
+		}
+		if c.Interval == 0 {
+			c.Interval = 40
+			if c.NoDelay {
+				c.Interval = 20
+			}
+		}
+		if c.Resend == 0 && c.NoDelay {
+			c.Resend = 2
+		}
+		for _, v := range []struct {
+			name     string
+			v, lower int
+		}{
+			{"snd_wnd", c.SndWnd, 1}, {"rcv_wnd", c.RcvWnd, 1}, {"interval", c.Interval, 1},
+			{"resend", c.Resend, 0}, {"data_shards", c.DataShards, 0}, {"parity_shards", c.ParityShards, 0},
+		} {
+			// windows are told in 16 bits
+			if v.v < v.lower || v.v > 65535 {
+				return nil, fmt.Errorf("kcp %s out of range: %d", v.name, v.v)
+			}
+		}
+		if c.DataShards == 0 || c.ParityShards == 0 {
+			c.DataShards, c.ParityShards = 0, 0
+		} else if _, err := newFECEncoder(c.DataShards, c.ParityShards); err != nil {
+			return nil, fmt.Errorf("kcp fec: %s", err)
+		}
+		if c.MTU < 2*(arqOverhead+fecHeaderSize+fecSizeLen) || c.MTU > 65000 {
+			return nil, fmt.Errorf("kcp mtu out of range: %d", c.MTU)
+		}
+		return &kcpTransport{config: c}, nil
+	})
+}
+
+type kcpTransport struct {
+	config KCPConfig
+}
+
+func (t *kcpTransport) Dial(network, addr string) (net.Conn, error) {
+	raddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	udp, err := net.DialUDP("udp", nil, raddr)
+	if err != nil {
+		return nil, err
+	}
+	var conv [4]byte
+	if _, err = rand.Read(conv[:]); err != nil {
+		udp.Close()
+		return nil, err
+	}
+	c, err := t.newConn(binary.LittleEndian.Uint32(conv[:]), udp.LocalAddr(), raddr, func(p []byte) {
+		udp.Write(p)
+	}, false)
+	if err != nil {
+		udp.Close()
+		return nil, err
+	}
+	c.release = func() { udp.Close() }
+	go func() {
+		buf := make([]byte, kcpBufSize)
+		for {
+			n, err := udp.Read(buf)
+			if err != nil {
+				if errors.Is(err, net.ErrClosed) {
+					return
+				}
+				// ICMP unreachable, retransmission will tell
+				continue
+			}
+			c.input(buf[:n])
+		}
+	}()
+	return clientTLS(c)
+}
+
+func (t *kcpTransport) Listen(network, addr string) (net.Listener, error) {
+	pc, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	l := &kcpListener{
+		chanListener: newChanListenerAddr(pc.LocalAddr()),
+		transport:    t,
+		pc:           pc,
+		conns:        make(map[string]*kcpConn),
+	}
+	l.onClose = l.closeAll
+	go l.serve()
+	return serverTLS(l)
+}
+
+// kcpListener demultiplex packets of one UDP socket into sessions
+type kcpListener struct {
+	*chanListener
+	transport *kcpTransport
+	pc        net.PacketConn
+
+	mu    sync.Mutex
+	conns map[string]*kcpConn
+}
+
+func (l *kcpListener) serve() {
+	buf := make([]byte, kcpBufSize)
+	for {
+		n, from, err := l.pc.ReadFrom(buf)
+		if err != nil {
+			l.fail(err)
+			return
+		}
+		key := from.String()
+		l.mu.Lock()
+		c := l.conns[key]
+		l.mu.Unlock()
+		if c == nil {
+			conv, ok := l.transport.opening(buf[:n])
+			if !ok {
+				continue
+			}
+			if c, err = l.transport.newConn(conv, l.pc.LocalAddr(), from, func(p []byte) {
+				l.pc.WriteTo(p, from)
+			}, true); err != nil {
+				continue
+			}
+			c.release = func() {
+				l.mu.Lock()
+				if l.conns[key] == c {
+					delete(l.conns, key)
+				}
+				l.mu.Unlock()
+			}
+			l.mu.Lock()
+			l.conns[key] = c
+			l.mu.Unlock()
+			go l.push(c)
+		}
+		c.input(buf[:n])
+	}
+}
+
+func (l *kcpListener) closeAll() error {
+	err := l.pc.Close()
+	l.mu.Lock()
+	conns := make([]*kcpConn, 0, len(l.conns))
+	for _, c := range l.conns {
+		conns = append(conns, c)
+	}
+	l.mu.Unlock()
+	for _, c := range conns {
+		c.fail(net.ErrClosed)
+	}
+	return err
+}
+
+// opening conv of pkt if it is the first PUSH of a session
+func (t *kcpTransport) opening(pkt []byte) (uint32, bool) {
+	if t.config.DataShards > 0 {
+		if len(pkt) < fecHeaderSize || binary.LittleEndian.Uint16(pkt[4:]) != fecTypeData {
+			return 0, false
+		}
+		var ok bool
+		if pkt, ok = fecPayload(pkt[fecHeaderSize:]); !ok {
+			return 0, false
+		}
+	}
+	if len(pkt) < arqOverhead || pkt[4] != arqCmdPush || binary.LittleEndian.Uint32(pkt[12:]) != 0 {
+		return 0, false
+	}
+	return binary.LittleEndian.Uint32(pkt), true
+}
+
+// newConn session of conv, limited if the remote address is not proven yet
+func (t *kcpTransport) newConn(conv uint32, local, remote net.Addr, write func([]byte), limited bool) (*kcpConn, error) {
+	cfg := t.config
+	var epoch [4]byte
+	if _, err := rand.Read(epoch[:]); err != nil {
+		return nil, err
+	}
+	c := &kcpConn{
+		local:    local,
+		remote:   remote,
+		epoch:    binary.LittleEndian.Uint32(epoch[:]),
+		limited:  limited,
+		readable: make(chan struct{}, 1),
+		writable: make(chan struct{}, 1),
+		die:      make(chan struct{}),
+		lastRecv: time.Now(),
+		lastSend: time.Now(),
+	}
+	raw := write
+	write = func(p []byte) {
+		if c.limited && !c.arq.routable {
+			// dropped ones are retransmitted as if lost
+			if c.sent+len(p) > kcpAmplification*c.received {
+				return
+			}
+			c.sent += len(p)
+		}
+		raw(p)
+	}
+	output := func(p []byte) {
+		c.lastSend = time.Now()
+		write(p)
+	}
+	mtu := cfg.MTU
+	if cfg.DataShards > 0 {
+		enc, err := newFECEncoder(cfg.DataShards, cfg.ParityShards)
+		if err != nil {
+			return nil, err
+		}
+		if c.dec, err = newFECDecoder(cfg.DataShards, cfg.ParityShards); err != nil {
+			return nil, err
+		}
+		output = func(p []byte) {
+			c.lastSend = time.Now()
+			enc.encode(p, write)
+		}
+		mtu -= fecHeaderSize + fecSizeLen
+	}
+	c.arq = newARQ(conv, output)
+	c.arq.setMTU(mtu)
+	c.arq.setWndSize(cfg.SndWnd, cfg.RcvWnd)
+	c.arq.setNoDelay(cfg.NoDelay, cfg.Interval, cfg.Resend, cfg.NoCongestion)
+	c.arq.pad = !limited
+	go c.update(time.Duration(cfg.Interval) * time.Millisecond)
+	return c, nil
+}
+
+func (c *kcpConn) now() uint32 {
+	return c.epoch + uint32(time.Since(kcpEpoch)/time.Millisecond)
+}
+
+// kcpConn net.Conn of an ARQ session
+type kcpConn struct {
+	local   net.Addr
+	remote  net.Addr
+	release func()
+
+	mu            sync.Mutex
+	arq           *arq
+	dec           *fecDecoder
+	epoch         uint32 // random start of clock, so that TS is unguessable
+	limited       bool
+	received      int
+	sent          int
+	closed        bool
+	lastRecv      time.Time
+	lastSend      time.Time
+	readDeadline  time.Time
+	writeDeadline time.Time
+
+	readable chan struct{}
+	writable chan struct{}
+	die      chan struct{}
+	dieOnce  sync.Once
+	err      error
+}
+
+// update flush the session every interval, and release it once done
+func (c *kcpConn) update(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-c.die:
+			return
+		}
+		now := time.Now()
+		c.mu.Lock()
+		if now.Sub(c.lastSend) > kcpKeepalive {
+			c.arq.probe |= arqAskTell
+		}
+		c.arq.current = c.now()
+		c.arq.flush(false)
+		var err error
+		switch {
+		case c.arq.dead:
+			err = ErrKCPDeadLink
+		case now.Sub(c.lastRecv) > kcpIdle:
+			err = ErrKCPIdle
+		case c.closed && c.arq.waitSnd() == 0:
+			err = net.ErrClosed
+		}
+		writable := c.canWrite()
+		c.mu.Unlock()
+
+		if err != nil {
+			c.fail(err)
+			return
+		}
+		if writable {
+			notify(c.writable)
+		}
+	}
+}
+
+// room segments may be queued, twice the send window
+func (c *kcpConn) room() int {
+	return 2*int(c.arq.sndWnd) - c.arq.waitSnd()
+}
+
+func (c *kcpConn) canWrite() bool {
+	return c.room() > 0
+}
+
+// input a packet from peer
+func (c *kcpConn) input(pkt []byte) {
+	c.mu.Lock()
+	c.lastRecv = time.Now()
+	c.received += len(pkt)
+	c.arq.pad = false
+	c.arq.current = c.now()
+	if c.dec != nil {
+		c.dec.decode(pkt, func(p []byte, recovered bool) { c.arq.input(p, !recovered) })
+	} else {
+		c.arq.input(pkt, true)
+	}
+	if c.arq.nodelay && len(c.arq.ackList) > 0 {
+		c.arq.flush(true)
+	}
+	readable := c.arq.rcvQueue.Len() > 0 || c.arq.finRecv
+	writable := c.canWrite()
+	c.mu.Unlock()
+
+	if readable {
+		notify(c.readable)
+	}
+	if writable {
+		notify(c.writable)
+	}
+}
+
+// fail tear down the session at once
+func (c *kcpConn) fail(err error) {
+	c.dieOnce.Do(func() {
+		c.err = err
+		close(c.die)
+		if c.release != nil {
+			c.release()
+		}
+	})
+}
+
+// wait ch till deadline
+func (c *kcpConn) wait(ch chan struct{}, deadline time.Time) error {
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		d := time.Until(deadline)
+		if d <= 0 {
+			return errTimeout
+		}
+		timer := time.NewTimer(d)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	select {
+	case <-ch:
+		return nil
+	case <-timeout:
+		return errTimeout
+	case <-c.die:
+		return c.err
+	}
+}
+
+func (c *kcpConn) Read(b []byte) (int, error) {
+	for {
+		c.mu.Lock()
+		if c.arq.rcvQueue.Len() > 0 {
+			n := c.arq.recv(b)
+			c.mu.Unlock()
+			return n, nil
+		}
+		if c.arq.finRecv {
+			c.mu.Unlock()
+			return 0, io.EOF
+		}
+		if c.closed {
+			c.mu.Unlock()
+			return 0, net.ErrClosed
+		}
+		deadline := c.readDeadline
+		c.mu.Unlock()
+
+		if err := c.wait(c.readable, deadline); err != nil {
+			return 0, err
+		}
+	}
+}
+
+func (c *kcpConn) Write(b []byte) (n int, err error) {
+	for len(b) > 0 {
+		c.mu.Lock()
+		if c.closed {
+			c.mu.Unlock()
+			return n, net.ErrClosed
+		}
+		if room := c.room(); room > 0 {
+			size := room * int(c.arq.mss)
+			if size > len(b) {
+				size = len(b)
+			}
+			c.arq.send(b[:size])
+			if c.arq.nodelay {
+				c.arq.current = c.now()
+				c.arq.flush(false)
+			}
+			c.mu.Unlock()
+			n += size
+			b = b[size:]
+			continue
+		}
+		deadline := c.writeDeadline
+		c.mu.Unlock()
+
+		if err = c.wait(c.writable, deadline); err != nil {
+			return
+		}
+	}
+	return
+}
+
+// Close send FIN after pending data, the session is released once acknowledged
+func (c *kcpConn) Close() error {
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return nil
+	}
+	c.closed = true
+	c.arq.sendFin()
+	c.mu.Unlock()
+	notify(c.readable)
+	notify(c.writable)
+	return nil
+}
+
+func (c *kcpConn) LocalAddr() net.Addr  { return c.local }
+func (c *kcpConn) RemoteAddr() net.Addr { return c.remote }
+
+func (c *kcpConn) SetDeadline(t time.Time) error {
+	c.SetReadDeadline(t)
+	return c.SetWriteDeadline(t)
+}
+
+func (c *kcpConn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.readDeadline = t
+	c.mu.Unlock()
+	notify(c.readable)
+	return nil
+}
+
+func (c *kcpConn) SetWriteDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.writeDeadline = t
+	c.mu.Unlock()
+	notify(c.writable)
+	return nil
+}
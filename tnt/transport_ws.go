@@ -0,0 +1,164 @@
+package tnt
+
+import (
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// ws transport carry the tunnel in binary frames of a WebSocket, so that
+// it may sit behind nginx or CDN. Server accepts upgrades on ws_path only,
+// other requests are proxied to the fallback address.
+
+func init() {
+	RegisterTransport("ws", func(config *Config) (Transport, error) {
+		path := config.WSPath
+		if path == "" {
+			path = "/"
+		}
+		host := config.WSHost
+		if host == "" {
+			host = config.TargetDomain
+		}
+		return &wsTransport{
+			host:     host,
+			path:     path,
+			fallback: net.JoinHostPort(config.TargetDomain, strconv.Itoa(int(config.TargetPort))),
+		}, nil
+	})
+}
+
+type wsTransport struct {
+	host     string
+	path     string
+	fallback string
+}
+
+func (t *wsTransport) Dial(network, addr string) (net.Conn, error) {
+	dialer := &websocket.Dialer{
+		NetDial: func(string, string) (net.Conn, error) {
+			return dialRaw(network, addr)
+		},
+		HandshakeTimeout: ReadTimeout,
+		ReadBufferSize:   maxFrameData,
+		WriteBufferSize:  maxFrameData,
+	}
+	u := url.URL{Scheme: "ws", Host: t.host, Path: t.path}
+	header := http.Header{"User-Agent": {httpUserAgent}}
+	ws, _, err := dialer.Dial(u.String(), header)
+	if err != nil {
+		return nil, err
+	}
+	return newWSConn(ws), nil
+}
+
+func (t *wsTransport) Listen(network, addr string) (net.Listener, error) {
+	ln, err := listenRaw(network, addr)
+	if err != nil {
+		return nil, err
+	}
+	l := newChanListener(ln)
+	srv := &http.Server{
+		Handler:           t.handler(l),
+		ReadHeaderTimeout: ReadTimeout,
+		ErrorLog:          log.New(ioutil.Discard, "", 0),
+	}
+	go func() {
+		l.fail(srv.Serve(ln))
+	}()
+	return l, nil
+}
+
+func (t *wsTransport) handler(l *chanListener) http.Handler {
+	upgrader := &websocket.Upgrader{
+		ReadBufferSize:  maxFrameData,
+		WriteBufferSize: maxFrameData,
+		CheckOrigin:     func(*http.Request) bool { return true },
+	}
+	proxy := httputil.NewSingleHostReverseProxy(&url.URL{Scheme: "http", Host: t.fallback})
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != t.path || !websocket.IsWebSocketUpgrade(r) {
+			proxy.ServeHTTP(w, r)
+			return
+		}
+		ws, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			log.Println("[TRANSPORT] upgrade error", err)
+			return
+		}
+		l.push(newWSConn(ws))
+	})
+}
+
+// wsConn net.Conn of binary messages
+type wsConn struct {
+	*websocket.Conn
+	r  io.Reader
+	mu sync.Mutex
+}
+
+func newWSConn(ws *websocket.Conn) *wsConn {
+	return &wsConn{Conn: ws}
+}
+
+func (c *wsConn) Read(b []byte) (int, error) {
+	for {
+		if c.r == nil {
+			tp, r, err := c.NextReader()
+			if err != nil {
+				if websocket.IsCloseError(err, websocket.CloseNormalClosure) {
+					return 0, io.EOF
+				}
+				return 0, err
+			}
+			if tp != websocket.BinaryMessage {
+				continue
+			}
+			c.r = r
+		}
+		n, err := c.r.Read(b)
+		if err == io.EOF {
+			c.r = nil
+			if n == 0 {
+				continue
+			}
+			err = nil
+		}
+		return n, err
+	}
+}
+
+func (c *wsConn) Write(b []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := c.WriteMessage(websocket.BinaryMessage, b); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// Close send close message, then close the connection
+func (c *wsConn) Close() error {
+	c.mu.Lock()
+	c.WriteControl(websocket.CloseMessage,
+		websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""),
+		time.Now().Add(time.Second))
+	c.mu.Unlock()
+	return c.Conn.Close()
+}
+
+func (c *wsConn) SetDeadline(t time.Time) error {
+	if err := c.SetReadDeadline(t); err != nil {
+		return err
+	}
+	return c.SetWriteDeadline(t)
+}
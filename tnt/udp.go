@@ -0,0 +1,222 @@
+package tnt
+
+import (
+	"log"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// UDP association carry datagrams over a tunnel connection.
+// It begins with a TrafficUDPAssociate, after that every traffic is a
+// TrafficUDP whose payload is:
+// | ATYP | ADDR | PORT | DATA     |
+// |  1   | Var  |  2   | Variable |
+// ADDR is the destination from client, and the source from server.
+
+var (
+	// UDPTimeout idle time before NAT mapping expire
+	UDPTimeout = 60 * time.Second
+)
+
+// UDPTunnel client side of an udp association
+type UDPTunnel struct {
+	conn net.Conn
+	mu   sync.Mutex
+}
+
+// DialUDPTunnel start an udp association to server
+func DialUDPTunnel(network, addr string, cipher *Cipher) (*UDPTunnel, error) {
+	c, err := connectToServer(network, addr, NewTraffic(TrafficUDPAssociate, nil), cipher)
+	if err != nil {
+		return nil, err
+	}
+	return &UDPTunnel{conn: c}, nil
+}
+
+// WriteTo send datagram to rawaddr through tunnel
+func (t *UDPTunnel) WriteTo(rawaddr, data []byte) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return writeDatagram(t.conn, rawaddr, data)
+}
+
+// ReadFrom receive datagram from tunnel, rawaddr is its source
+func (t *UDPTunnel) ReadFrom() (rawaddr, data []byte, err error) {
+	return readDatagram(t.conn)
+}
+
+func (t *UDPTunnel) Close() error {
+	return t.conn.Close()
+}
+
+func writeDatagram(conn net.Conn, rawaddr, data []byte) error {
+	if len(rawaddr)+len(data) > MaxPayloadLen {
+		return ErrPayloadTooLarge
+	}
+	payload := make([]byte, len(rawaddr)+len(data))
+	copy(payload, rawaddr)
+	copy(payload[len(rawaddr):], data)
+	t := NewTraffic(TrafficUDP, payload)
+	t.Version = TrafficVersion2
+	_, err := conn.Write(t.Bytes())
+	return err
+}
+
+func readDatagram(conn net.Conn) (rawaddr, data []byte, err error) {
+	for {
+		t, err := UnMarshalTraffic(conn)
+		if err != nil {
+			return nil, nil, err
+		}
+		if t.Type != TrafficUDP {
+			log.Println("[UDP] unexpected traffic", t.Type)
+			continue
+		}
+		return SplitRawAddr(t.Payload)
+	}
+}
+
+type natEntry struct {
+	addr   *net.UDPAddr
+	active time.Time
+}
+
+// ServeUDP server side of an udp association, relay datagrams between
+// tunnel and targets through one udp socket. Mappings of target expire
+// after UDPTimeout idle, so as the association itself. Datagrams to
+// targets not allowed are dropped.
+func ServeUDP(tunnel net.Conn, allow func(host string) bool) {
+	pc, err := net.ListenUDP("udp", nil)
+	if err != nil {
+		log.Println("[UDP] listen error", err)
+		return
+	}
+	defer pc.Close()
+	defer tunnel.Close()
+
+	var mu sync.Mutex
+	nat := make(map[string]*natEntry) // key of target address
+	lastActive := time.Now()
+
+	touch := func(key string, addr *net.UDPAddr) {
+		mu.Lock()
+		nat[key] = &natEntry{addr: addr, active: time.Now()}
+		lastActive = time.Now()
+		mu.Unlock()
+	}
+
+	// janitor
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		ticker := time.NewTicker(UDPTimeout / 2)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case now := <-ticker.C:
+				mu.Lock()
+				for key, e := range nat {
+					if now.Sub(e.active) > UDPTimeout {
+						delete(nat, key)
+					}
+				}
+				idle := now.Sub(lastActive) > UDPTimeout
+				mu.Unlock()
+				if idle {
+					log.Println("[UDP] association idle")
+					tunnel.Close()
+					pc.Close()
+					return
+				}
+			}
+		}
+	}()
+
+	// target -> tunnel
+	go func() {
+		defer tunnel.Close()
+		var wmu sync.Mutex
+		buf := make([]byte, 64*1024)
+		for {
+			n, addr, err := pc.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			key := addr.String()
+			mu.Lock()
+			_, ok := nat[key]
+			mu.Unlock()
+			if !ok {
+				// only peers we have sent to may answer
+				continue
+			}
+			touch(key, addr)
+			wmu.Lock()
+			err = writeDatagram(tunnel, IPRawAddr(addr.IP, addr.Port), buf[:n])
+			wmu.Unlock()
+			if err != nil && err != ErrPayloadTooLarge {
+				return
+			}
+		}
+	}()
+
+	// tunnel -> target
+	for {
+		rawaddr, data, err := readDatagram(tunnel)
+		if err != nil {
+			return
+		}
+		host, err := ParseRawAddr(rawaddr)
+		if err != nil {
+			log.Println("[UDP]", err)
+			continue
+		}
+		if !allow(host) {
+			log.Println("[UDP] not allowed", host)
+			continue
+		}
+		addr, err := net.ResolveUDPAddr("udp", host)
+		if err != nil {
+			log.Println("[UDP] resolve error", err)
+			continue
+		}
+		touch(addr.String(), addr)
+		if _, err = pc.WriteToUDP(data, addr); err != nil {
+			log.Println("[UDP] write error", err)
+		}
+	}
+}
+
+// IPRawAddr rawaddr of ip and port
+func IPRawAddr(ip net.IP, port int) []byte {
+	var b []byte
+	if ip4 := ip.To4(); ip4 != nil {
+		b = append([]byte{typeIPv4}, ip4...)
+	} else {
+		b = append([]byte{typeIPv6}, ip.To16()...)
+	}
+	return append(b, byte(port>>8), byte(port))
+}
+
+// AddrRawAddr rawaddr of host:port
+func AddrRawAddr(hostport string) ([]byte, error) {
+	host, port, err := net.SplitHostPort(hostport)
+	if err != nil {
+		return nil, err
+	}
+	p, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return nil, err
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		return IPRawAddr(ip, int(p)), nil
+	}
+	if len(host) > 255 {
+		return nil, ErrBadAddr
+	}
+	return RawAddr(host, uint16(p)), nil
+}
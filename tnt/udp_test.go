@@ -0,0 +1,58 @@
+package tnt
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestServeUDPAllow(t *testing.T) {
+	allowedPC, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer allowedPC.Close()
+	deniedPC, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer deniedPC.Close()
+
+	client, server := net.Pipe()
+	defer client.Close()
+	go ServeUDP(server, func(host string) bool { return host == allowedPC.LocalAddr().String() })
+
+	for _, pc := range []net.PacketConn{deniedPC, allowedPC} {
+		rawaddr, err := AddrRawAddr(pc.LocalAddr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = writeDatagram(client, rawaddr, []byte("ping")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	buf := make([]byte, 64)
+	allowedPC.SetReadDeadline(time.Now().Add(2 * time.Second))
+	n, from, err := allowedPC.ReadFrom(buf)
+	if err != nil || string(buf[:n]) != "ping" {
+		t.Fatalf("allowed target got %q, %v", buf[:n], err)
+	}
+	deniedPC.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	if n, _, err = deniedPC.ReadFrom(buf); err == nil {
+		t.Fatalf("denied target got %q", buf[:n])
+	}
+
+	// answer of allowed target comes back
+	if _, err = allowedPC.WriteTo([]byte("pong"), from); err != nil {
+		t.Fatal(err)
+	}
+	rawaddr, data, err := readDatagram(client)
+	if err != nil || !bytes.Equal(data, []byte("pong")) {
+		t.Fatalf("got %q, %v", data, err)
+	}
+	if host, _ := ParseRawAddr(rawaddr); host != allowedPC.LocalAddr().String() {
+		t.Fatalf("answer from %s", host)
+	}
+}
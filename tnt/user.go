@@ -0,0 +1,160 @@
+package tnt
+
+import (
+	"crypto/hmac"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"sync"
+	"sync/atomic"
+)
+
+var (
+	ErrUnknownUser   = errors.New("no user matches")
+	ErrQuotaExceeded = errors.New("quota exceeded")
+)
+
+// User credential of one user on server
+type User struct {
+	Name     string `json:"name"`
+	Password string `json:"password"`
+	Quota    int64  `json:"quota"` // bytes, 0 means unlimited
+	Disabled bool   `json:"disabled"`
+}
+
+type userEntry struct {
+	*User
+	cipher *Cipher
+	used   int64
+}
+
+// consume account n bytes to user
+func (u *userEntry) consume(n int) error {
+	used := atomic.AddInt64(&u.used, int64(n))
+	if u.Quota > 0 && used > u.Quota {
+		return ErrQuotaExceeded
+	}
+	return nil
+}
+
+// Keyring ciphers of users, identify who is connecting by trying
+// the key of every user against the first authenticated chunk.
+type Keyring struct {
+	mu    sync.RWMutex
+	users []*userEntry
+}
+
+// NewKeyring derive ciphers for users
+func NewKeyring(method string, users []*User, kdf *KDFConfig) (*Keyring, error) {
+	if len(users) == 0 {
+		return nil, errors.New("no user")
+	}
+	k := new(Keyring)
+	for _, u := range users {
+		c, err := NewCipherWithKDF(method, u.Password, kdf)
+		if err != nil {
+			return nil, fmt.Errorf("user %s: %v", u.Name, err)
+		}
+		k.users = append(k.users, &userEntry{User: u, cipher: c})
+	}
+	return k, nil
+}
+
+// Revoke disable user, new connections of the user will be rejected
+func (k *Keyring) Revoke(name string) {
+	k.mu.Lock()
+	for _, u := range k.users {
+		if u.Name == name {
+			u.Disabled = true
+		}
+	}
+	k.mu.Unlock()
+}
+
+// Used bytes consumed by user
+func (k *Keyring) Used(name string) (used int64) {
+	k.mu.RLock()
+	for _, u := range k.users {
+		if u.Name == name {
+			used = atomic.LoadInt64(&u.used)
+		}
+	}
+	k.mu.RUnlock()
+	return
+}
+
+func (k *Keyring) active() (users []*userEntry) {
+	k.mu.RLock()
+	for _, u := range k.users {
+		if !u.Disabled {
+			users = append(users, u)
+		}
+	}
+	k.mu.RUnlock()
+	return
+}
+
+// identify find the user whose key opens the first chunk size,
+// return the length of its payload.
+func (c *Conn) identify(iv []byte) (payloadLen int, err error) {
+	if !c.IsAEAD() {
+		return 0, errors.New("identify users requires AEAD method")
+	}
+	// users share the same method, so as the overhead
+	if err = c.initDecrpt(iv); err != nil {
+		return
+	}
+	buf := make([]byte, lenChunkSize+c.aeadDec.Overhead())
+	if _, err = io.ReadFull(c.Conn, buf); err != nil {
+		return
+	}
+	for _, u := range c.Keyring.active() {
+		cipher := u.cipher.Copy()
+		if err = cipher.initDecrpt(iv); err != nil {
+			return
+		}
+		size, err := cipher.open(nil, buf)
+		if err != nil {
+			continue
+		}
+		c.attach(u, cipher)
+		return int(binary.BigEndian.Uint16(size)) & maxChunkSize, nil
+	}
+	return 0, ErrUnknownUser
+}
+
+func (c *Conn) attach(u *userEntry, cipher *Cipher) {
+	c.Cipher = cipher
+	c.user = u
+	c.User = u.Name
+	log.Println("[USER]", u.Name)
+}
+
+// ServerHandshakeKeyring identify user by MAC of the handshake
+func ServerHandshakeKeyring(conn *Conn, replay *ReplayFilter) (err error) {
+	msg, err := readHello(conn.Conn)
+	if err != nil {
+		return
+	}
+	for _, u := range conn.Keyring.active() {
+		if !hmac.Equal(msg[lenPublicKey:], hsMac(u.cipher.key, hsClientLabel, msg[:lenPublicKey])) {
+			continue
+		}
+		cipher, err := serverRespond(conn.Conn, u.cipher, msg, replay)
+		if err != nil {
+			return err
+		}
+		conn.attach(u, cipher)
+		return nil
+	}
+	return ErrHandshake
+}
+
+// Cipher template for connections awaiting identification
+func (k *Keyring) Cipher() *Cipher {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	return k.users[0].cipher.Copy()
+}